@@ -0,0 +1,36 @@
+package adapters
+
+import "time"
+
+const (
+	LoadAuditOperation             = "load"
+	InsertAuditOperation           = "insert"
+	UpsertAuditOperation           = "upsert"
+	DeduplicatedLoadAuditOperation = "deduplicated_load"
+)
+
+//Audit record of one google BigQuery load (into target or staging table), streaming insert, upsert or deduplicated load
+type AuditEvent struct {
+	//configured principal (GoogleConfig.AuditPrincipal)
+	Principal string
+	Operation string
+	Dataset   string
+	Table     string
+	//loaded, inserted or affected by merge/insert query rows count (0 if unknown or failed)
+	Rows int64
+	//load or query job id (empty for streaming inserts)
+	JobID     string
+	Timestamp time.Time
+	Success   bool
+	Error     string
+}
+
+//Destination of audit events (e.g. compliance log). Emit must be safe for concurrent use
+type AuditSink interface {
+	Emit(event *AuditEvent)
+}
+
+//Default audit sink which drops all events
+type noOpAuditSink struct{}
+
+func (noOpAuditSink) Emit(*AuditEvent) {}
@@ -2,18 +2,25 @@ package adapters
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"net/http"
+	"time"
 )
 
 type AwsS3 struct {
+	ctx    context.Context
 	config *S3Config
 	client *s3.S3
+	clock  Clock
 }
 
 type S3Config struct {
@@ -21,6 +28,9 @@ type S3Config struct {
 	SecretKey   string `mapstructure:"secret_access_key"`
 	Bucket      string `mapstructure:"bucket"`
 	Region      string `mapstructure:"region"`
+	//retries count of failed uploads (negative - disabled) and base delay of exponential backoff between them
+	UploadRetries    int           `mapstructure:"upload_retries"`
+	UploadRetryDelay time.Duration `mapstructure:"upload_retry_delay"`
 }
 
 func (s3c *S3Config) Validate() error {
@@ -43,31 +53,62 @@ func (s3c *S3Config) Validate() error {
 	return nil
 }
 
-func NewAwsS3(s3Config *S3Config) (*AwsS3, error) {
+//Create aws s3 adapter
+//Additional aws configs (e.g. custom http client) are applied after credentials and region
+func NewAwsS3(ctx context.Context, s3Config *S3Config, awsConfigs ...*aws.Config) (*AwsS3, error) {
 	awsConfig := aws.NewConfig().
 		WithCredentials(credentials.NewStaticCredentials(s3Config.AccessKeyID, s3Config.SecretKey, "")).
 		WithRegion(s3Config.Region)
 	s3Session := session.Must(session.NewSession())
 
-	return &AwsS3{client: s3.New(s3Session, awsConfig), config: s3Config}, nil
+	return &AwsS3{ctx: ctx, client: s3.New(s3Session, append([]*aws.Config{awsConfig}, awsConfigs...)...), config: s3Config, clock: realClock{}}, nil
+}
+
+//Set source of the current time and timers used for upload retries backoff (real clock if nil)
+//Should be called before the adapter usage
+func (a *AwsS3) SetClock(clock Clock) {
+	if clock == nil {
+		clock = realClock{}
+	}
+	a.clock = clock
 }
 
 //Create named file on aws s3 with payload
+//Upload is retried on transient errors (aws client retries are disabled in this case for not multiplying attempts)
 func (a *AwsS3) UploadBytes(fileName string, fileBytes []byte) error {
 	fileType := http.DetectContentType(fileBytes)
-	params := &s3.PutObjectInput{
-		Bucket:      aws.String(a.config.Bucket),
-		Key:         aws.String(fileName),
-		Body:        bytes.NewReader(fileBytes),
-		ContentType: aws.String(fileType),
+
+	var opts []request.Option
+	if a.config.UploadRetries > 0 {
+		opts = append(opts, func(r *request.Request) { r.Retryer = client.NoOpRetryer{} })
 	}
-	_, err := a.client.PutObject(params)
+
+	err := retry(a.ctx, a.clock, a.config.UploadRetries, a.config.UploadRetryDelay, isRetryableS3Err, func() error {
+		params := &s3.PutObjectInput{
+			Bucket:      aws.String(a.config.Bucket),
+			Key:         aws.String(fileName),
+			Body:        bytes.NewReader(fileBytes),
+			ContentType: aws.String(fileType),
+		}
+		_, err := a.client.PutObjectWithContext(a.ctx, params, opts...)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("Error uploading file to s3 %v", err)
 	}
 	return nil
 }
 
+//Return true if err is aws throttling, retryable or 5xx error
+func isRetryableS3Err(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() >= http.StatusInternalServerError
+}
+
 //Return aws s3 bucket file names
 func (a *AwsS3) ListBucket() ([]string, error) {
 	input := &s3.ListObjectsV2Input{Bucket: &a.config.Bucket}
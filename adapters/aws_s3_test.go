@@ -0,0 +1,71 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAwsS3UploadBytesRetries(t *testing.T) {
+	unavailable := `<?xml version="1.0" encoding="UTF-8"?><Error><Code>ServiceUnavailable</Code><Message>Please reduce your request rate.</Message></Error>`
+	tests := []struct {
+		name          string
+		retries       int
+		failures      int
+		expectErr     bool
+		expectedCalls int
+		//bounds of backoff delays sum (with jitter) measured with the fake clock
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		{"fail twice then succeed", 3, 2, false, 3, 1500 * time.Millisecond, 3 * time.Second},
+		{"retries are exhausted", 1, 2, true, 2, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			mutex := sync.Mutex{}
+			httpClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				mutex.Lock()
+				calls++
+				call := calls
+				mutex.Unlock()
+
+				require.Equal(t, http.MethodPut, req.Method)
+				statusCode, body := http.StatusOK, ""
+				if call <= tt.failures {
+					statusCode, body = http.StatusServiceUnavailable, unavailable
+				}
+				return &http.Response{
+					StatusCode: statusCode,
+					Header:     http.Header{"Content-Type": []string{"application/xml"}},
+					Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+					Request:    req,
+				}, nil
+			})}
+
+			s3Adapter, err := NewAwsS3(context.Background(), &S3Config{AccessKeyID: "key", SecretKey: "secret", Bucket: "bucket", Region: "us-east-1",
+				UploadRetries: tt.retries, UploadRetryDelay: time.Second}, aws.NewConfig().WithHTTPClient(httpClient))
+			require.NoError(t, err)
+			clock := newFakeClock()
+			start := clock.Now()
+			s3Adapter.SetClock(clock)
+
+			err = s3Adapter.UploadBytes("file", []byte(`{"key":"value"}`))
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expectedCalls, calls, "aws client mustn't retry uploads in addition to UploadBytes retries")
+			waited := clock.Now().Sub(start)
+			require.True(t, waited >= tt.minWait && waited <= tt.maxWait, "Unexpected backoff delays sum: %s", waited)
+		})
+	}
+}
@@ -3,97 +3,347 @@ package adapters
 import (
 	"cloud.google.com/go/bigquery"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ksensehq/eventnative/schema"
+	"github.com/ksensehq/eventnative/timestamp"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"log"
+	"math"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	maxLabelLength      = 63
+	labelKeyPrefix      = "label_"
+	maxValueAlias       = "max_value"
+	rowNumberAlias      = "_dedup_row_number"
+	maxClusteringFields = 4
+	//BigQuery limit of source URIs count of one load job
+	maxLoadJobSourceURIs = 10000
+
+	descriptionDatePlaceholder = "{date}"
+
+	//BigQuery streaming insert row limit
+	defaultMaxInsertRowSize = 10 << 20
+)
+
+var (
+	ErrTableNotFound = errors.New("BigQuery table doesn't exist")
+	ErrReadOnly      = errors.New("BigQuery adapter is in read-only mode")
+
+	errUnknownBooleanToken = errors.New("Unknown boolean token")
 )
 
 var (
+	//TIMESTAMP values are loaded from JSON files as strings in timestamp.Layout format
 	SchemaToBigQuery = map[schema.DataType]bigquery.FieldType{
-		schema.STRING: bigquery.StringFieldType,
+		schema.STRING:    bigquery.StringFieldType,
+		schema.INTEGER:   bigquery.IntegerFieldType,
+		schema.FLOAT:     bigquery.FloatFieldType,
+		schema.BOOLEAN:   bigquery.BooleanFieldType,
+		schema.TIMESTAMP: bigquery.TimestampFieldType,
 	}
 
+	//standard SQL type names are mapped as well as legacy ones
 	BigQueryToSchema = map[bigquery.FieldType]schema.DataType{
-		bigquery.StringFieldType: schema.STRING,
+		bigquery.StringFieldType:    schema.STRING,
+		bigquery.IntegerFieldType:   schema.INTEGER,
+		"INT64":                     schema.INTEGER,
+		bigquery.FloatFieldType:     schema.FLOAT,
+		"FLOAT64":                   schema.FLOAT,
+		bigquery.BooleanFieldType:   schema.BOOLEAN,
+		"BOOL":                      schema.BOOLEAN,
+		bigquery.TimestampFieldType: schema.TIMESTAMP,
 	}
 )
 
+//supported formats of files loaded from google cloud storage
+var sourceFormats = map[string]bigquery.DataFormat{
+	"json":    bigquery.JSON,
+	"csv":     bigquery.CSV,
+	"parquet": bigquery.Parquet,
+	"avro":    bigquery.Avro,
+}
+
+//google BigQuery job which status can be waited or polled
+type waitableJob interface {
+	Wait(ctx context.Context) (*bigquery.JobStatus, error)
+	Status(ctx context.Context) (*bigquery.JobStatus, error)
+}
+
+//streaming insert row: column name -> value
+type insertRow map[string]bigquery.Value
+
+//Implement bigquery.ValueSaver (empty insert id - generated by google client)
+func (r *insertRow) Save() (map[string]bigquery.Value, string, error) {
+	return *r, "", nil
+}
+
 type BigQuery struct {
-	ctx    context.Context
-	client *bigquery.Client
-	config *GoogleConfig
+	ctx     context.Context
+	client  *bigquery.Client
+	config  *GoogleConfig
+	breaker *CircuitBreaker
+	//serialize schema patches per table for avoiding ETag conflicts
+	patchLocks    *keyedMutex
+	metadataCache *metadataCache
+	auditSink     AuditSink
+	deadLetters   DeadLetterSink
+	clock         Clock
+	//applied to rows of streaming inserts
+	columnTransform schema.ColumnTransform
 }
 
-func NewBigQuery(ctx context.Context, config *GoogleConfig) (*BigQuery, error) {
+//Create google BigQuery adapter
+//Additional client options (e.g. custom http client, connection pool size) are applied after credentials
+//so they take precedence over options derived from GoogleConfig
+func NewBigQuery(ctx context.Context, config *GoogleConfig, opts ...option.ClientOption) (*BigQuery, error) {
 	credentials := extractCredentials(config)
-	client, err := bigquery.NewClient(ctx, config.Project, credentials)
+	client, err := bigquery.NewClient(ctx, config.Project, append(credentials, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating BigQuery client: %v", err)
 	}
 
-	return &BigQuery{ctx: ctx, client: client, config: config}, nil
+	breaker := NewCircuitBreaker("BigQuery", config.CircuitBreakerThreshold, config.CircuitBreakerCooldown, isOutageErr)
+	return &BigQuery{
+		ctx:           ctx,
+		client:        client,
+		config:        config,
+		breaker:       breaker,
+		patchLocks:    newKeyedMutex(),
+		metadataCache: newMetadataCache(config.MetadataCacheTTL),
+		auditSink:     noOpAuditSink{},
+		deadLetters:   noOpDeadLetterSink{},
+		clock:         realClock{},
+	}, nil
 }
 
 //Transfer data from google cloud storage file to google BigQuery table
 //as one batch
 func (bq *BigQuery) Copy(fileKey, tableName string) error {
-	table := bq.client.Dataset(bq.config.Dataset).Table(tableName)
+	return bq.CopyFiles([]string{fileKey}, tableName)
+}
 
-	gcsRef := bigquery.NewGCSReference(fmt.Sprintf("gs://%s/%s", bq.config.Bucket, fileKey))
-	gcsRef.SourceFormat = bigquery.JSON
+//Transfer data from several google cloud storage files to google BigQuery table
+//with one load job per maxLoadJobSourceURIs files. Every load job is audited separately
+//Retries reuse the job id until the job is completed: files are never loaded twice
+//If one of the jobs fails, files of the previous (completed) jobs stay loaded
+func (bq *BigQuery) CopyFiles(fileKeys []string, tableName string) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	table := bq.table(tableName)
+	for _, chunk := range chunkFileKeys(fileKeys, maxLoadJobSourceURIs) {
+		event := &AuditEvent{Operation: LoadAuditOperation, Dataset: table.DatasetID, Table: table.TableID}
+		err := bq.breaker.Execute(func() error {
+			return bq.retryJob("load", func(jobID string) (*bigquery.JobStatus, error) {
+				return bq.copyFiles(chunk, table, jobID, event)
+			})
+		})
+		bq.audit(event, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Return fileKeys split into consecutive chunks of at most size keys
+func chunkFileKeys(fileKeys []string, size int) [][]string {
+	var chunks [][]string
+	for len(fileKeys) > size {
+		chunks = append(chunks, fileKeys[:size])
+		fileKeys = fileKeys[size:]
+	}
+	if len(fileKeys) > 0 {
+		chunks = append(chunks, fileKeys)
+	}
+
+	return chunks
+}
+
+//Run load job with jobID from google cloud storage files to google BigQuery table (see runIdempotentJob) and wait for it
+//Return status of the job if it has been completed (successfully or not)
+//Job id and loaded rows count are written into the audit event
+func (bq *BigQuery) copyFiles(fileKeys []string, table *bigquery.Table, jobID string, event *AuditEvent) (*bigquery.JobStatus, error) {
+	tableName := table.TableID
+
+	gcsRef, err := bq.gcsReference(fileKeys...)
+	if err != nil {
+		return nil, err
+	}
 	loader := table.LoaderFrom(gcsRef)
+	loader.JobID = jobID
 	loader.CreateDisposition = bigquery.CreateNever
+	loader.Labels = bq.loadLabels(table)
 
-	job, err := loader.Run(bq.ctx)
-	if err != nil {
-		return fmt.Errorf("Error running loading from google cloud storage to BigQuery table %s: %v", tableName, err)
+	job, jobStatus, err := bq.runIdempotentJob(jobID, loader.Run)
+	if job == nil {
+		if isTableNotFoundErr(err) {
+			bq.invalidateMetadata(table)
+			return nil, fmt.Errorf("Error running loading of %d files from google cloud storage to BigQuery table %s: %w", len(fileKeys), tableName, ErrTableNotFound)
+		}
+		return nil, fmt.Errorf("Error running loading of %d files from google cloud storage to BigQuery table %s: %w", len(fileKeys), tableName, err)
 	}
-	jobStatus, err := job.Wait(bq.ctx)
+	event.JobID = job.ID()
 	if err != nil {
-		return fmt.Errorf("Error waiting loading job from google cloud storage to BigQuery table %s: %v", tableName, err)
+		return nil, fmt.Errorf("Error waiting loading job of %d files from google cloud storage to BigQuery table %s: %w", len(fileKeys), tableName, err)
 	}
 
-	if jobStatus.Err() != nil {
-		return fmt.Errorf("Error loading from google cloud storage to BigQuery table %s: %v", tableName, err)
+	if err := jobStatus.Err(); err != nil {
+		if isTableNotFoundErr(err) {
+			bq.invalidateMetadata(table)
+			return jobStatus, fmt.Errorf("Error loading %d files from google cloud storage to BigQuery table %s: %w", len(fileKeys), tableName, ErrTableNotFound)
+		}
+		return jobStatus, fmt.Errorf("Error loading %d files from google cloud storage to BigQuery table %s: %w", len(fileKeys), tableName, err)
 	}
 
-	return nil
+	event.Rows = jobAffectedRows(jobStatus)
+
+	return jobStatus, nil
+}
+
+//Transfer data from google cloud storage file to google BigQuery table
+//If the table doesn't exist:
+// - return ErrTableNotFound if GoogleConfig.CreateMissingTables is false
+// - create the table from tableSchema and retry otherwise
+func (bq *BigQuery) CopyWithSchema(fileKey string, tableSchema *schema.Table) error {
+	err := bq.Copy(fileKey, tableSchema.Name)
+	if err == nil || !errors.Is(err, ErrTableNotFound) || !bq.config.CreateMissingTables {
+		return err
+	}
+
+	log.Printf("BigQuery table %s doesn't exist. It will be created and file %s will be loaded again", tableSchema.Name, fileKey)
+	if err := bq.CreateTable(tableSchema); err != nil {
+		return err
+	}
+
+	return bq.Copy(fileKey, tableSchema.Name)
+}
+
+//Transfer data from google cloud storage file to the specified day partition of
+//ingestion-time partitioned google BigQuery table (via table$YYYYMMDD decorator)
+func (bq *BigQuery) CopyToPartition(fileKey, tableName string, partition time.Time) error {
+	return bq.Copy(fileKey, partitionDecorator(tableName, partition))
+}
+
+//Transfer data from google cloud storage files to scratch google BigQuery table which is removed by BigQuery after expiration
+//The table is created from tableSchema with expiration time if it doesn't exist (expiration of existing table isn't changed)
+func (bq *BigQuery) CopyToTemporaryTable(fileKeys []string, tableSchema *schema.Table, expiration time.Duration) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if expiration <= 0 {
+		return fmt.Errorf("Error loading into temporary BigQuery table %s: expiration must be positive", tableSchema.Name)
+	}
+
+	if err := bq.createTableWithExpiration(tableSchema, expiration); err != nil {
+		return err
+	}
+
+	return bq.CopyFiles(fileKeys, tableSchema.Name)
 }
 
-//Return google BigQuery table representation(name, columns with types) as schema.Table
+//Return google BigQuery table representation(name, columns with types, partitioning, clustering, labels) as schema.Table
+//Return nil if table doesn't exist and table with empty columns if table exists without schema
+//(e.g. freshly created before the first load)
 func (bq *BigQuery) GetTableSchema(tableName string) (*schema.Table, error) {
 	table := &schema.Table{Name: tableName, Columns: schema.Columns{}}
+	exists := true
 
-	bqTable := bq.client.Dataset(bq.config.Dataset).Table(tableName)
+	err := bq.breaker.Execute(func() error {
+		bqTable := bq.table(tableName)
 
-	meta, err := bqTable.Metadata(bq.ctx)
-	if err != nil {
-		if isNotFoundErr(err) {
-			return table, nil
+		meta, err := bq.tableMetadata(bqTable)
+		if err != nil {
+			if isNotFoundErr(err) {
+				exists = false
+				return nil
+			}
+
+			return fmt.Errorf("Error querying BigQuery table [%s] metadata: %w", tableName, err)
 		}
 
-		return nil, fmt.Errorf("Error querying BigQuery table [%s] metadata: %v", tableName, err)
-	}
+		for _, field := range meta.Schema {
+			mappedType, ok := BigQueryToSchema[field.Type]
+			if !ok {
+				log.Println("Unknown BigQuery column type:", field.Type)
+				mappedType = schema.STRING
+			}
+			table.Columns[field.Name] = schema.Column{Type: mappedType, Mode: columnMode(field)}
+		}
 
-	for _, field := range meta.Schema {
-		mappedType, ok := BigQueryToSchema[field.Type]
-		if !ok {
-			log.Println("Unknown BigQuery column type:", field.Type)
-			mappedType = schema.STRING
+		if meta.TimePartitioning != nil {
+			table.Partitioning = &schema.TimePartitioning{Field: meta.TimePartitioning.Field, Type: schema.DayPartitionType}
+		}
+		if meta.Clustering != nil {
+			table.ClusteringFields = append([]string{}, meta.Clustering.Fields...)
+		}
+		if len(meta.Labels) > 0 {
+			table.Labels = map[string]string{}
+			for k, v := range meta.Labels {
+				table.Labels[k] = v
+			}
 		}
-		table.Columns[field.Name] = schema.Column{Type: mappedType}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, nil
 	}
 
 	return table, nil
 }
 
 //Create google BigQuery table from schema.Table
+//Table is partitioned by schema.Table partitioning field and clustered by clustering fields if they are set
 func (bq *BigQuery) CreateTable(tableSchema *schema.Table) error {
-	bqTable := bq.client.Dataset(bq.config.Dataset).Table(tableSchema.Name)
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return bq.createTableWithExpiration(tableSchema, 0)
+}
+
+//Create google BigQuery table from schema.Table which expires after expiration (0 - never expires)
+func (bq *BigQuery) createTableWithExpiration(tableSchema *schema.Table, expiration time.Duration) error {
+	if _, err := bq.timePartitioning(tableSchema); err != nil {
+		return err
+	}
+	if _, err := clustering(tableSchema); err != nil {
+		return err
+	}
+
+	return bq.breaker.Execute(func() error {
+		return bq.retry(func() error {
+			return bq.createTable(tableSchema, expiration)
+		})
+	})
+}
+
+//Create google BigQuery table if it doesn't exist
+//Existence is checked without the metadata cache: cached table could be dropped
+func (bq *BigQuery) createTable(tableSchema *schema.Table, expiration time.Duration) error {
+	bqTable := bq.table(tableSchema.Name)
 
 	_, err := bqTable.Metadata(bq.ctx)
 	if err == nil {
@@ -102,21 +352,44 @@ func (bq *BigQuery) CreateTable(tableSchema *schema.Table) error {
 	}
 
 	if !isNotFoundErr(err) {
-		return fmt.Errorf("Error getting new table %s metadata: %v", tableSchema.Name, err)
+		return fmt.Errorf("Error getting new table %s metadata: %w", tableSchema.Name, err)
 	}
 
 	bqSchema := bigquery.Schema{}
 	for columnName, column := range tableSchema.Columns {
-		mappedType, ok := SchemaToBigQuery[column.Type]
-		if !ok {
-			log.Println("Unknown BigQuery schema type:", column.Type)
-			mappedType = SchemaToBigQuery[schema.STRING]
+		bqSchema = append(bqSchema, bq.fieldSchema(columnName, column))
+	}
+
+	timePartitioning, err := bq.timePartitioning(tableSchema)
+	if err != nil {
+		return err
+	}
+
+	tableClustering, err := clustering(tableSchema)
+	if err != nil {
+		return err
+	}
+
+	tableMetadata := &bigquery.TableMetadata{Name: tableSchema.Name, Schema: bqSchema, TimePartitioning: timePartitioning, Clustering: tableClustering}
+	if len(tableSchema.Labels) > 0 {
+		tableMetadata.Labels = map[string]string{}
+		for k, v := range tableSchema.Labels {
+			tableMetadata.Labels[sanitizeLabel(k)] = sanitizeLabel(v)
 		}
-		bqSchema = append(bqSchema, &bigquery.FieldSchema{Name: columnName, Type: mappedType})
+	}
+	if expiration > 0 {
+		tableMetadata.ExpirationTime = bq.clock.Now().Add(expiration)
 	}
 
-	if err := bqTable.Create(bq.ctx, &bigquery.TableMetadata{Name: tableSchema.Name, Schema: bqSchema}); err != nil {
-		return fmt.Errorf("Error creating [%s] BigQuery table %v", tableSchema.Name, err)
+	//table metadata will be requested again on the next usage
+	defer bq.metadataCache.Invalidate(metadataCacheKey(bqTable))
+	if err := bqTable.Create(bq.ctx, tableMetadata); err != nil {
+		//table might be created concurrently
+		if isAlreadyExistsErr(err) {
+			log.Println("BigQuery table", tableSchema.Name, "already exists")
+			return nil
+		}
+		return fmt.Errorf("Error creating [%s] BigQuery table %w", tableSchema.Name, err)
 	}
 
 	return nil
@@ -124,67 +397,1387 @@ func (bq *BigQuery) CreateTable(tableSchema *schema.Table) error {
 
 //Create google BigQuery Dataset if doesn't exist
 func (bq *BigQuery) CreateDataset(dataset string) error {
-	bqDataset := bq.client.Dataset(dataset)
-	if _, err := bqDataset.Metadata(bq.ctx); err != nil {
-		if isNotFoundErr(err) {
-			if err := bqDataset.Create(bq.ctx, &bigquery.DatasetMetadata{Name: dataset}); err != nil {
-				return fmt.Errorf("Error creating dataset %s in BigQuery: %v", dataset, err)
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return bq.breaker.Execute(func() error {
+		dataset = normalizeName(dataset, bq.config.NameCase)
+		bqDataset := bq.client.Dataset(dataset)
+		if _, err := bqDataset.Metadata(bq.ctx); err != nil {
+			if isNotFoundErr(err) {
+				//dataset might be created concurrently
+				if err := bqDataset.Create(bq.ctx, &bigquery.DatasetMetadata{Name: dataset}); err != nil && !isAlreadyExistsErr(err) {
+					return fmt.Errorf("Error creating dataset %s in BigQuery: %w", dataset, err)
+				}
+			} else {
+				return fmt.Errorf("Error getting dataset %s in BigQuery: %w", dataset, err)
 			}
-		} else {
-			return fmt.Errorf("Error getting dataset %s in BigQuery: %v", dataset, err)
 		}
+
+		return nil
+	})
+}
+
+//Create configured dataset (if it is configured) and table if they don't exist
+//Safe for retries and concurrent calls: already existing dataset and table (including created concurrently) aren't errors
+func (bq *BigQuery) Bootstrap(tableSchema *schema.Table) error {
+	if bq.config.Dataset != "" {
+		if err := bq.CreateDataset(bq.config.Dataset); err != nil {
+			return fmt.Errorf("Error bootstrapping BigQuery table %s: %w", tableSchema.Name, err)
+		}
+	}
+
+	if err := bq.CreateTable(tableSchema); err != nil {
+		return fmt.Errorf("Error bootstrapping BigQuery table %s: %w", tableSchema.Name, err)
 	}
 
 	return nil
 }
 
+//Bring google BigQuery table to tableSchema (e.g. loaded with schema.LoadTableSpec or schema.LoadTableSpecYAML):
+//create the table if it doesn't exist or add missing columns otherwise
+//Return error if type or mode of an existing column differs from tableSchema: BigQuery columns can't be changed in place
+//Partitioning, clustering and labels of existing tables aren't changed
+func (bq *BigQuery) Reconcile(tableSchema *schema.Table) error {
+	existing, err := bq.GetTableSchema(tableSchema.Name)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		return bq.CreateTable(tableSchema)
+	}
+
+	//BigQuery column names are case-insensitive
+	existingColumns := map[string]schema.Column{}
+	for columnName, column := range existing.Columns {
+		existingColumns[strings.ToLower(columnName)] = column
+	}
+	var columnNames []string
+	for columnName := range tableSchema.Columns {
+		columnNames = append(columnNames, columnName)
+	}
+	sort.Strings(columnNames)
+	for _, columnName := range columnNames {
+		existingColumn, ok := existingColumns[strings.ToLower(columnName)]
+		if !ok {
+			continue
+		}
+		column := tableSchema.Columns[columnName]
+		if existingColumn.Type != column.Type {
+			return fmt.Errorf("Error reconciling BigQuery table %s: column %s type is %s but %s is required", tableSchema.Name, columnName, existingColumn.Type, column.Type)
+		}
+		if existingColumn.Mode != column.Mode {
+			return fmt.Errorf("Error reconciling BigQuery table %s: column %s mode is %s but %s is required", tableSchema.Name, columnName, existingColumn.Mode, column.Mode)
+		}
+	}
+
+	diff := existing.Diff(tableSchema)
+	if !diff.Exists() {
+		return nil
+	}
+
+	return bq.PatchTableSchema(diff)
+}
+
 //Add schema.Table columns to google BigQuery table
-func (bq *BigQuery) PatchTableSchema(patchSchema *schema.Table) error {
-	bqTable := bq.client.Dataset(bq.config.Dataset).Table(patchSchema.Name)
+//Columns are appended in columnOrder order, the rest of them (or all if columnOrder is empty) in alphabetical order
+//Columns are added with several sequential updates (not more than GoogleConfig.PatchMaxColumns columns per each)
+//if the limit is configured
+func (bq *BigQuery) PatchTableSchema(patchSchema *schema.Table, columnOrder ...string) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	columnNames, err := orderColumns(patchSchema, columnOrder)
+	if err != nil {
+		return err
+	}
+
+	//patches of the same table are serialized, different tables are patched in parallel
+	unlock := bq.patchLocks.Lock(normalizeName(patchSchema.Name, bq.config.NameCase))
+	defer unlock()
+
+	return bq.breaker.Execute(func() error {
+		bqTable := bq.table(patchSchema.Name)
+
+		//all columns are validated before the first update: invalid patch doesn't add any chunk
+		if err := bq.validatePatchModes(bqTable, patchSchema, columnNames); err != nil {
+			return err
+		}
+
+		for _, chunk := range splitColumns(columnNames, bq.config.PatchMaxColumns) {
+			chunk := chunk
+			//metadata (and ETag) is requested again on every attempt
+			if err := bq.retry(func() error { return bq.patchTableSchema(bqTable, patchSchema, chunk) }); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//Return error if any of REQUIRED patchSchema columns isn't in google BigQuery table yet
+//(BigQuery allows adding only NULLABLE or REPEATED columns to existing tables)
+//Table metadata is requested only if there are REQUIRED columns
+func (bq *BigQuery) validatePatchModes(bqTable *bigquery.Table, patchSchema *schema.Table, columnNames []string) error {
+	var requiredColumns []string
+	for _, columnName := range columnNames {
+		if patchSchema.Columns[columnName].Mode == schema.REQUIRED {
+			requiredColumns = append(requiredColumns, columnName)
+		}
+	}
+	if len(requiredColumns) == 0 {
+		return nil
+	}
+
+	var metadata *bigquery.TableMetadata
+	err := bq.retry(func() (err error) {
+		metadata, err = bqTable.Metadata(bq.ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error getting table %s metadata: %w", patchSchema.Name, err)
+	}
+
+	existingColumns := map[string]bool{}
+	for _, field := range metadata.Schema {
+		existingColumns[strings.ToLower(field.Name)] = true
+	}
+
+	for _, columnName := range requiredColumns {
+		if !existingColumns[strings.ToLower(columnName)] {
+			return fmt.Errorf("Error patching %s BigQuery table: column %s is REQUIRED but BigQuery allows adding only NULLABLE or REPEATED columns to existing tables", patchSchema.Name, columnName)
+		}
+	}
+
+	return nil
+}
+
+//Add columns with names from patchSchema to google BigQuery table with one update request
+//metadata (and ETag) is requested before every update (bypassing the metadata cache) and updated metadata is cached
+func (bq *BigQuery) patchTableSchema(bqTable *bigquery.Table, patchSchema *schema.Table, columnNames []string) error {
+	cacheKey := metadataCacheKey(bqTable)
+	bq.metadataCache.Invalidate(cacheKey)
+
 	metadata, err := bqTable.Metadata(bq.ctx)
 	if err != nil {
-		return fmt.Errorf("Error getting table %s metadata: %v", patchSchema.Name, err)
+		return fmt.Errorf("Error getting table %s metadata: %w", patchSchema.Name, err)
 	}
 
-	for columnName, column := range patchSchema.Columns {
-		mappedColumnType, ok := SchemaToBigQuery[column.Type]
-		if !ok {
-			log.Println("Unknown BigQuery schema type:", column.Type.String())
-			mappedColumnType = SchemaToBigQuery[schema.STRING]
+	existingColumns := map[string]bool{}
+	for _, field := range metadata.Schema {
+		existingColumns[strings.ToLower(field.Name)] = true
+	}
+
+	//BigQuery column names are case-insensitive: skip columns which are already in the table
+	added := 0
+	for _, columnName := range columnNames {
+		if existingColumns[strings.ToLower(columnName)] {
+			continue
 		}
-		metadata.Schema = append(metadata.Schema, &bigquery.FieldSchema{Name: columnName, Type: mappedColumnType})
+		metadata.Schema = append(metadata.Schema, bq.fieldSchema(columnName, patchSchema.Columns[columnName]))
+		existingColumns[strings.ToLower(columnName)] = true
+		added++
+	}
+
+	if added == 0 {
+		bq.metadataCache.Put(cacheKey, metadata)
+		return nil
 	}
 
 	updateReq := bigquery.TableMetadataToUpdate{Schema: metadata.Schema}
-	if _, err := bqTable.Update(bq.ctx, updateReq, metadata.ETag); err != nil {
+	updated, err := bqTable.Update(bq.ctx, updateReq, metadata.ETag)
+	if err != nil {
 		var columns []string
 		for _, column := range metadata.Schema {
 			columns = append(columns, fmt.Sprintf("%s - %s", column.Name, column.Type))
 		}
-		return fmt.Errorf("Error patching %s BigQuery table with %s schema: %v", patchSchema.Name, strings.Join(columns, ","), err)
+		return fmt.Errorf("Error patching %s BigQuery table with %s schema: %w", patchSchema.Name, strings.Join(columns, ","), err)
 	}
 
+	bq.metadataCache.Put(cacheKey, updated)
 	return nil
 }
 
-func (bq *BigQuery) Close() error {
-	if err := bq.client.Close(); err != nil {
-		return fmt.Errorf("Error closing BigQuery client: %v", err)
+//Insert rows into google BigQuery table with streaming inserts (for small batches without GCS staging)
+//Values are transformed with configured column transformation functions (see SetColumnTransform),
+//rows with failed transformations are sent to the dead-letter sink (see SetDeadLetterSink)
+//and converted to table column types (BOOLEAN strings with GoogleConfig.TrueTokens and FalseTokens,
+//unknown tokens are handled according to GoogleConfig.UnknownBooleanTokenPolicy),
+//columns which aren't in the table are skipped
+//Rows bigger than GoogleConfig.MaxInsertRowSize fail the insert before sending or are sent to the dead-letter sink
+//(GoogleConfig.OversizedRowPolicy, see SetDeadLetterSink)
+//Per-row insert errors are aggregated into one error or logged if GoogleConfig.InsertSkipInvalidRows is set
+//(valid rows are inserted in this case)
+func (bq *BigQuery) Insert(tableName string, rows []map[string]interface{}) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
 	}
 
-	return nil
+	if len(rows) == 0 {
+		return nil
+	}
+
+	table := bq.table(tableName)
+	event := &AuditEvent{Operation: InsertAuditOperation, Dataset: table.DatasetID, Table: table.TableID}
+	err := bq.breaker.Execute(func() error {
+		metadata, err := bq.tableMetadata(table)
+		if err != nil {
+			if isTableNotFoundErr(err) {
+				return fmt.Errorf("Error getting table %s metadata: %w", tableName, ErrTableNotFound)
+			}
+			return fmt.Errorf("Error getting table %s metadata: %w", tableName, err)
+		}
+
+		booleanTokens := bq.config.booleanTokens()
+		columnFields := map[string]*bigquery.FieldSchema{}
+		for _, field := range metadata.Schema {
+			columnFields[field.Name] = field
+		}
+
+		maxRowSize := bq.config.MaxInsertRowSize
+		if maxRowSize <= 0 {
+			maxRowSize = defaultMaxInsertRowSize
+		}
+
+		var savers []*insertRow
+		//indexes of savers rows in rows
+		var rowIndexes []int
+		for i, row := range rows {
+			if len(bq.columnTransform) > 0 {
+				//rows of the caller aren't changed
+				transformed := make(map[string]interface{}, len(row))
+				for name, value := range row {
+					transformed[name] = value
+				}
+				//the same as in the schema processor: the row is skipped and the rest rows are inserted
+				if err := bq.columnTransform.Apply(transformed); err != nil {
+					log.Printf("Warn: row %d will be skipped from inserting into BigQuery table %s and sent to the dead-letter sink: %v", i, tableName, err)
+					bq.deadLetter(table, rows[i], i, err.Error())
+					continue
+				}
+				row = transformed
+			}
+
+			saver := insertRow{}
+			var deadLetterReason string
+			for name, value := range row {
+				field, ok := columnFields[name]
+				if !ok {
+					continue
+				}
+
+				converted, err := convertFieldValue(value, field, booleanTokens)
+				if err != nil {
+					if errors.Is(err, errUnknownBooleanToken) {
+						switch strings.ToLower(bq.config.UnknownBooleanTokenPolicy) {
+						case NullUnknownBooleanTokenPolicy:
+							continue
+						case DeadLetterUnknownBooleanTokenPolicy:
+							deadLetterReason = fmt.Sprintf("column %s value: %v", name, err)
+						}
+					}
+					if deadLetterReason == "" {
+						return fmt.Errorf("Error converting row %d column %s value: %v", i, name, err)
+					}
+					break
+				}
+				saver[name] = converted
+			}
+			if deadLetterReason != "" {
+				log.Printf("Warn: row %d will be skipped from inserting into BigQuery table %s and sent to the dead-letter sink: %s", i, tableName, deadLetterReason)
+				bq.deadLetter(table, rows[i], i, deadLetterReason)
+				continue
+			}
+
+			//oversized row fails the whole insert request
+			rowBytes, err := json.Marshal(saver)
+			if err != nil {
+				return fmt.Errorf("Error serializing row %d: %v", i, err)
+			}
+			if len(rowBytes) > maxRowSize {
+				if strings.ToLower(bq.config.OversizedRowPolicy) == SkipOversizedRowPolicy {
+					log.Printf("Row %d (%d bytes) exceeds max insert row size %d bytes and will be skipped from inserting into BigQuery table %s and sent to the dead-letter sink", i, len(rowBytes), maxRowSize, tableName)
+					bq.deadLetter(table, rows[i], i, fmt.Sprintf("row size %d bytes exceeds max insert row size %d bytes", len(rowBytes), maxRowSize))
+					continue
+				}
+				return fmt.Errorf("Error inserting into BigQuery table %s: row %d (%d bytes) exceeds max insert row size %d bytes", tableName, i, len(rowBytes), maxRowSize)
+			}
+
+			savers = append(savers, &saver)
+			rowIndexes = append(rowIndexes, i)
+		}
+
+		if len(savers) == 0 {
+			return nil
+		}
+
+		inserter := table.Inserter()
+		inserter.SkipInvalidRows = bq.config.InsertSkipInvalidRows
+		inserter.IgnoreUnknownValues = bq.config.InsertIgnoreUnknownValues
+		if err := inserter.Put(bq.ctx, savers); err != nil {
+			if multiErr, ok := err.(bigquery.PutMultiError); ok {
+				var rowErrs []string
+				for _, rowErr := range multiErr {
+					rowIndex := rowErr.RowIndex
+					if rowIndex >= 0 && rowIndex < len(rowIndexes) {
+						rowIndex = rowIndexes[rowIndex]
+					}
+					for _, e := range rowErr.Errors {
+						rowErrs = append(rowErrs, fmt.Sprintf("row %d: %v", rowIndex, e))
+					}
+				}
+				if bq.config.InsertSkipInvalidRows {
+					log.Printf("%d of %d rows were skipped from inserting into BigQuery table %s: %s", len(multiErr), len(savers), tableName, strings.Join(rowErrs, "; "))
+					event.Rows = int64(len(savers) - len(multiErr))
+					return nil
+				}
+				return fmt.Errorf("Error inserting %d of %d rows into BigQuery table %s: %s", len(multiErr), len(savers), tableName, strings.Join(rowErrs, "; "))
+			}
+			if isTableNotFoundErr(err) {
+				bq.invalidateMetadata(table)
+				return fmt.Errorf("Error inserting rows into BigQuery table %s: %w", tableName, ErrTableNotFound)
+			}
+			return fmt.Errorf("Error inserting rows into BigQuery table %s: %w", tableName, err)
+		}
+
+		event.Rows = int64(len(savers))
+		return nil
+	})
+	bq.audit(event, err)
+
+	return err
 }
 
-//Return true if google err is 404
-func isNotFoundErr(err error) bool {
-	e, ok := err.(*googleapi.Error)
-	return ok && e.Code == http.StatusNotFound
+//Set column transformation functions applied to streaming inserts rows before values conversion (nil - disabled)
+func (bq *BigQuery) SetColumnTransform(columnTransform schema.ColumnTransform) {
+	bq.columnTransform = columnTransform
+}
+
+//Set source of the current time and timers (real clock if nil)
+//Should be called before the adapter usage
+func (bq *BigQuery) SetClock(clock Clock) {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	bq.clock = clock
+	if bq.breaker != nil {
+		bq.breaker.clock = clock
+	}
+	if bq.metadataCache != nil {
+		bq.metadataCache.clock = clock
+	}
+}
+
+//Set destination of load and insert audit events (nil - events are dropped)
+func (bq *BigQuery) SetAuditSink(sink AuditSink) {
+	if sink == nil {
+		sink = noOpAuditSink{}
+	}
+	bq.auditSink = sink
+}
+
+//Set destination of rows rejected from streaming inserts (nil - rows are dropped)
+func (bq *BigQuery) SetDeadLetterSink(sink DeadLetterSink) {
+	if sink == nil {
+		sink = noOpDeadLetterSink{}
+	}
+	bq.deadLetters = sink
+}
+
+//Send original row of the caller (with index in the batch) rejected from table with reason to the dead-letter sink
+func (bq *BigQuery) deadLetter(table *bigquery.Table, row map[string]interface{}, rowIndex int, reason string) {
+	if bq.deadLetters == nil {
+		return
+	}
+
+	bq.deadLetters.Send(&DeadLetter{
+		Dataset:   table.DatasetID,
+		Table:     table.TableID,
+		Row:       row,
+		RowIndex:  rowIndex,
+		Reason:    reason,
+		Timestamp: bq.clock.Now().UTC(),
+	})
+}
+
+//Complete audit event with the operation result and emit it to the audit sink
+//Dataset and table of the event are set by the caller from the (normalized) table handle
+func (bq *BigQuery) audit(event *AuditEvent, err error) {
+	if bq.auditSink == nil {
+		return
+	}
+
+	event.Principal = bq.config.AuditPrincipal
+	event.Timestamp = bq.clock.Now().UTC()
+	event.Success = err == nil
+	if err != nil {
+		event.Rows = 0
+		event.Error = err.Error()
+	}
+
+	bq.auditSink.Emit(event)
+}
+
+//Load google cloud storage files into google BigQuery target table with upsert semantics:
+//rows matched by keyColumns update only updateColumns (other columns are preserved), not matched rows are inserted
+//Files are loaded into temporary staging table (with target table schema) and merged with MERGE statement
+func (bq *BigQuery) Upsert(fileKeys []string, target string, keyColumns, updateColumns []string) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if len(fileKeys) == 0 {
+		return nil
+	}
+	if len(keyColumns) == 0 {
+		return fmt.Errorf("Error upserting into BigQuery table %s: key columns are required", target)
+	}
+
+	targetTable := bq.table(target)
+	event := &AuditEvent{Operation: UpsertAuditOperation, Dataset: targetTable.DatasetID, Table: targetTable.TableID}
+	err := bq.breaker.Execute(func() error {
+		metadata, columns, err := bq.targetColumns(targetTable, target, append(append([]string{}, keyColumns...), updateColumns...))
+		if err != nil {
+			return err
+		}
+
+		stagingTable, err := bq.loadStagingTable(fileKeys, targetTable, "upsert", metadata.Schema)
+		if err != nil {
+			return err
+		}
+		defer bq.deleteStagingTable(stagingTable)
+
+		query := bq.client.Query(mergeQuery(tableIdentifier(targetTable), tableIdentifier(stagingTable), keyColumns, updateColumns, columns))
+		if err := bq.runAuditedJob(query.Run, event); err != nil {
+			if isTableNotFoundErr(err) {
+				bq.invalidateMetadata(targetTable)
+			}
+			return fmt.Errorf("Error merging staging table into BigQuery table %s: %w", target, err)
+		}
+
+		return nil
+	})
+	bq.audit(event, err)
+
+	return err
+}
+
+//Load google cloud storage files into google BigQuery target table keeping only one row per keyColumns values
+//(duplicates within the files are collapsed): the row with the greatest orderColumns values e.g. the latest by timestamp
+//(arbitrary one if orderColumns is empty). Rows which are already in the target table aren't deduplicated
+//Files are loaded into temporary staging table (with target table schema) and inserted with ROW_NUMBER() query
+func (bq *BigQuery) CopyDeduplicated(fileKeys []string, target string, keyColumns, orderColumns []string) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if len(fileKeys) == 0 {
+		return nil
+	}
+	if len(keyColumns) == 0 {
+		return fmt.Errorf("Error loading deduplicated data into BigQuery table %s: key columns are required", target)
+	}
+
+	targetTable := bq.table(target)
+	event := &AuditEvent{Operation: DeduplicatedLoadAuditOperation, Dataset: targetTable.DatasetID, Table: targetTable.TableID}
+	err := bq.breaker.Execute(func() error {
+		metadata, columns, err := bq.targetColumns(targetTable, target, append(append([]string{}, keyColumns...), orderColumns...))
+		if err != nil {
+			return err
+		}
+
+		stagingTable, err := bq.loadStagingTable(fileKeys, targetTable, "dedup", metadata.Schema)
+		if err != nil {
+			return err
+		}
+		defer bq.deleteStagingTable(stagingTable)
+
+		query := bq.client.Query(dedupInsertQuery(tableIdentifier(targetTable), tableIdentifier(stagingTable), keyColumns, orderColumns, columns))
+		if err := bq.runAuditedJob(query.Run, event); err != nil {
+			if isTableNotFoundErr(err) {
+				bq.invalidateMetadata(targetTable)
+			}
+			return fmt.Errorf("Error inserting deduplicated staging table rows into BigQuery table %s: %w", target, err)
+		}
+
+		return nil
+	})
+	bq.audit(event, err)
+
+	return err
 }
 
-func extractCredentials(config *GoogleConfig) option.ClientOption {
+//Return target google BigQuery table metadata and column names
+//Return error if one of required columns isn't in the table
+func (bq *BigQuery) targetColumns(targetTable *bigquery.Table, target string, requiredColumns []string) (*bigquery.TableMetadata, []string, error) {
+	metadata, err := bq.tableMetadata(targetTable)
+	if err != nil {
+		if isTableNotFoundErr(err) {
+			bq.invalidateMetadata(targetTable)
+			return nil, nil, fmt.Errorf("Error getting table %s metadata: %w", target, ErrTableNotFound)
+		}
+		return nil, nil, fmt.Errorf("Error getting table %s metadata: %w", target, err)
+	}
+
+	var columns []string
+	existingColumns := map[string]bool{}
+	for _, field := range metadata.Schema {
+		columns = append(columns, field.Name)
+		existingColumns[field.Name] = true
+	}
+	for _, column := range requiredColumns {
+		if !existingColumns[column] {
+			return nil, nil, fmt.Errorf("Error loading into BigQuery table %s: column %s doesn't exist", target, column)
+		}
+	}
+
+	return metadata, columns, nil
+}
+
+//Create temporary staging table of target table with tableSchema and load google cloud storage files into it
+//with one load job per maxLoadJobSourceURIs files. Every load is audited as a load into the staging table
+//Staging table is removed by BigQuery after 1 hour even if it isn't deleted with deleteStagingTable
+func (bq *BigQuery) loadStagingTable(fileKeys []string, targetTable *bigquery.Table, kind string, tableSchema bigquery.Schema) (*bigquery.Table, error) {
+	target := targetTable.TableID
+	//source format is validated before the staging table creation
+	if _, err := sourceFormat(bq.config.SourceFormat); err != nil {
+		return nil, err
+	}
+
+	stagingTable := bq.table(fmt.Sprintf("%s_%s_%d", target, kind, bq.clock.Now().UnixNano()))
+	stagingMetadata := &bigquery.TableMetadata{Schema: tableSchema, ExpirationTime: bq.clock.Now().Add(time.Hour)}
+	if err := stagingTable.Create(bq.ctx, stagingMetadata); err != nil {
+		return nil, fmt.Errorf("Error creating staging table for loading into BigQuery table %s: %w", target, err)
+	}
+
+	for i, chunk := range chunkFileKeys(fileKeys, maxLoadJobSourceURIs) {
+		gcsRef, err := bq.gcsReference(chunk...)
+		if err != nil {
+			bq.deleteStagingTable(stagingTable)
+			return nil, err
+		}
+
+		loader := stagingTable.LoaderFrom(gcsRef)
+		loader.CreateDisposition = bigquery.CreateNever
+		//the first chunk overwrites the staging table, the rest are appended
+		loader.WriteDisposition = bigquery.WriteTruncate
+		if i > 0 {
+			loader.WriteDisposition = bigquery.WriteAppend
+		}
+		loader.Labels = bq.loadLabels(targetTable)
+		event := &AuditEvent{Operation: LoadAuditOperation, Dataset: stagingTable.DatasetID, Table: stagingTable.TableID}
+		err = bq.runAuditedJob(loader.Run, event)
+		bq.audit(event, err)
+		if err != nil {
+			bq.deleteStagingTable(stagingTable)
+			return nil, fmt.Errorf("Error loading %d files from google cloud storage to staging table of BigQuery table %s: %w", len(chunk), target, err)
+		}
+	}
+
+	return stagingTable, nil
+}
+
+//Delete staging table. Errors are only logged: the table expires anyway
+func (bq *BigQuery) deleteStagingTable(stagingTable *bigquery.Table) {
+	if err := stagingTable.Delete(bq.ctx); err != nil {
+		log.Printf("Error deleting BigQuery staging table %s: %v", stagingTable.TableID, err)
+	}
+}
+
+//Delete all rows from google BigQuery table (schema is preserved) with TRUNCATE TABLE statement
+//and wait for the job completion
+//Return ErrTableNotFound (wrapped) if the table doesn't exist
+func (bq *BigQuery) TruncateTable(tableName string) error {
+	if bq.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return bq.breaker.Execute(func() error {
+		table := bq.table(tableName)
+		defer bq.metadataCache.Invalidate(metadataCacheKey(table))
+
+		return bq.retryJob("truncate", func(jobID string) (*bigquery.JobStatus, error) {
+			query := bq.client.Query("TRUNCATE TABLE " + tableIdentifier(table))
+			query.JobID = jobID
+			_, jobStatus, err := bq.runIdempotentJob(jobID, query.Run)
+			if err == nil {
+				err = jobStatus.Err()
+			}
+			if err != nil {
+				if isTableNotFoundErr(err) {
+					return jobStatus, fmt.Errorf("Error truncating BigQuery table %s: %w", tableName, ErrTableNotFound)
+				}
+				return jobStatus, fmt.Errorf("Error truncating BigQuery table %s: %w", tableName, err)
+			}
+
+			return jobStatus, nil
+		})
+	})
+}
+
+//Run standard SQL query and return all result rows: column name -> value
+//Values are returned as Go types of BigQuery values: int64 (INTEGER), float64 (FLOAT), bool (BOOLEAN),
+//time.Time (TIMESTAMP), string (STRING), []interface{} (REPEATED) and map[string]interface{} (RECORD)
+//Empty slice is returned if there are no rows
+//Only SELECT statements are allowed in read-only mode (see isSelectStatement)
+func (bq *BigQuery) Query(sql string) ([]map[string]interface{}, error) {
+	if bq.config.ReadOnly && !isSelectStatement(sql) {
+		return nil, ErrReadOnly
+	}
+
+	var rows []map[string]interface{}
+	err := bq.breaker.Execute(func() error {
+		return bq.retryJob("query", func(jobID string) (*bigquery.JobStatus, error) {
+			rows = []map[string]interface{}{}
+			query := bq.client.Query(sql)
+			query.JobID = jobID
+			job, jobStatus, err := bq.runIdempotentJob(jobID, query.Run)
+			if err == nil {
+				err = jobStatus.Err()
+			}
+			if err != nil {
+				return jobStatus, fmt.Errorf("Error running BigQuery query [%s]: %w", sql, err)
+			}
+
+			it, err := job.Read(bq.ctx)
+			if err != nil {
+				return jobStatus, fmt.Errorf("Error reading BigQuery query [%s] results: %w", sql, err)
+			}
+			for {
+				var row map[string]bigquery.Value
+				err := it.Next(&row)
+				if err == iterator.Done {
+					return jobStatus, nil
+				}
+				if err != nil {
+					return jobStatus, fmt.Errorf("Error reading BigQuery query [%s] results: %w", sql, err)
+				}
+				rows = append(rows, queryRow(row))
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+//Return max value of the column in google BigQuery table (nil if the table is empty)
+//e.g. the latest event timestamp for incremental loads
+func (bq *BigQuery) GetMaxColumnValue(tableName, column string) (interface{}, error) {
+	rows, err := bq.Query(maxColumnValueQuery(tableIdentifier(bq.table(tableName)), column))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return rows[0][maxValueAlias], nil
+}
+
+//Return google BigQuery table metadata from the cache or request it (and cache) if it isn't cached
+func (bq *BigQuery) tableMetadata(table *bigquery.Table) (*bigquery.TableMetadata, error) {
+	cacheKey := metadataCacheKey(table)
+	if metadata, ok := bq.metadataCache.Get(cacheKey); ok {
+		return metadata, nil
+	}
+
+	metadata, err := table.Metadata(bq.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bq.metadataCache.Put(cacheKey, metadata)
+	return metadata, nil
+}
+
+//Remove table metadata from the cache
+//Called on table not found errors: cached table could be dropped and mustn't be treated as existing until cache TTL expires
+func (bq *BigQuery) invalidateMetadata(table *bigquery.Table) {
+	bq.metadataCache.Invalidate(metadataCacheKey(table))
+}
+
+//Return metadata cache key: dataset and table
+func metadataCacheKey(table *bigquery.Table) string {
+	return table.DatasetID + "." + table.TableID
+}
+
+//Run job and wait for it. Return run, wait or job error
+//Job id and affected rows count are written into the audit event
+func (bq *BigQuery) runAuditedJob(run func(ctx context.Context) (*bigquery.Job, error), event *AuditEvent) error {
+	job, err := run(bq.ctx)
+	if err != nil {
+		return err
+	}
+	event.JobID = job.ID()
+
+	jobStatus, err := bq.waitJob(job)
+	if err != nil {
+		return err
+	}
+	if err := jobStatus.Err(); err != nil {
+		return err
+	}
+
+	event.Rows = jobAffectedRows(jobStatus)
+	return nil
+}
+
+//Return loaded rows count of load job or affected rows count of DML query job (0 if unknown)
+func jobAffectedRows(jobStatus *bigquery.JobStatus) int64 {
+	if jobStatus.Statistics == nil {
+		return 0
+	}
+
+	switch details := jobStatus.Statistics.Details.(type) {
+	case *bigquery.LoadStatistics:
+		return details.OutputRows
+	case *bigquery.QueryStatistics:
+		return details.NumDMLAffectedRows
+	default:
+		return 0
+	}
+}
+
+//Run f with retries of transient google BigQuery errors (see isRetryableErr)
+//with GoogleConfig.Retries and GoogleConfig.RetryDelay settings
+func (bq *BigQuery) retry(f func() error) error {
+	return retry(bq.ctx, bq.clock, bq.config.Retries, bq.config.RetryDelay, isRetryableErr, f)
+}
+
+//Run job function f with retries (see retry) passing the same job id (with prefix) to all attempts
+//until f returns status of the completed job with error: the next attempt gets new job id
+func (bq *BigQuery) retryJob(prefix string, f func(jobID string) (*bigquery.JobStatus, error)) error {
+	jobID, err := newJobID(prefix)
+	if err != nil {
+		return err
+	}
+
+	return bq.retry(func() error {
+		jobStatus, err := f(jobID)
+		if err != nil && jobStatus != nil && jobStatus.Done() {
+			//failed job can't be run again with the same id
+			nextJobID, idErr := newJobID(prefix)
+			if idErr != nil {
+				return idErr
+			}
+			jobID = nextJobID
+		}
+		return err
+	})
+}
+
+//Submit job with jobID (run must submit job configured with jobID) or get already submitted job with the same id
+//(e.g. by the previous attempt which failed with transient error after submission) and wait for it
+//So retried job submissions don't run the same load or statement twice
+//Return nil job if it can't be submitted and got and nil job status if it isn't completed
+func (bq *BigQuery) runIdempotentJob(jobID string, run func(ctx context.Context) (*bigquery.Job, error)) (*bigquery.Job, *bigquery.JobStatus, error) {
+	job, err := run(bq.ctx)
+	if err != nil {
+		if !isAlreadyExistsErr(err) {
+			return nil, nil, err
+		}
+
+		if job, err = bq.client.JobFromID(bq.ctx, jobID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	jobStatus, err := bq.waitJob(job)
+	if err != nil {
+		return job, nil, err
+	}
+
+	return job, jobStatus, nil
+}
+
+func (bq *BigQuery) Close() error {
+	if err := bq.client.Close(); err != nil {
+		return fmt.Errorf("Error closing BigQuery client: %v", err)
+	}
+
+	return nil
+}
+
+//Wait for job completion
+//Job status is polled every GoogleConfig.JobPollInterval if it is configured (client default cadence otherwise)
+func (bq *BigQuery) waitJob(job waitableJob) (*bigquery.JobStatus, error) {
+	if bq.config.JobPollInterval <= 0 {
+		return job.Wait(bq.ctx)
+	}
+
+	for {
+		jobStatus, err := job.Status(bq.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if jobStatus.Done() {
+			return jobStatus, nil
+		}
+
+		select {
+		case <-bq.ctx.Done():
+			return nil, bq.ctx.Err()
+		case <-bq.clock.After(bq.config.JobPollInterval):
+		}
+	}
+}
+
+//Return google BigQuery field schema from schema.Column (with the column mode)
+//Description is taken from the configured column descriptions dictionary
+//or from the default description template (with the current date) if it is configured
+func (bq *BigQuery) fieldSchema(columnName string, column schema.Column) *bigquery.FieldSchema {
+	mappedType, ok := SchemaToBigQuery[column.Type]
+	if !ok {
+		log.Println("Unknown BigQuery schema type:", column.Type.String())
+		mappedType = SchemaToBigQuery[schema.STRING]
+	}
+
+	description, ok := bq.config.ColumnDescriptions[columnName]
+	if !ok && bq.config.DefaultColumnDescription != "" {
+		description = strings.ReplaceAll(bq.config.DefaultColumnDescription, descriptionDatePlaceholder, bq.clock.Now().UTC().Format("2006-01-02"))
+	}
+
+	return &bigquery.FieldSchema{
+		Name:        columnName,
+		Type:        mappedType,
+		Description: description,
+		Required:    column.Mode == schema.REQUIRED,
+		Repeated:    column.Mode == schema.REPEATED,
+	}
+}
+
+//Return google BigQuery time partitioning of the table:
+// - by schema.Table partitioning field (it must be TIMESTAMP column of the table)
+// - by load time if schema.Table partitioning field is empty or GoogleConfig.IngestionTimePartitioning is set
+// - nil if table isn't partitioned
+func (bq *BigQuery) timePartitioning(tableSchema *schema.Table) (*bigquery.TimePartitioning, error) {
+	partitioning := tableSchema.Partitioning
+	if partitioning == nil {
+		if bq.config.IngestionTimePartitioning {
+			//empty field means partitioning by _PARTITIONTIME pseudo column
+			return &bigquery.TimePartitioning{}, nil
+		}
+		return nil, nil
+	}
+
+	if partitioning.Type != "" && strings.ToUpper(partitioning.Type) != schema.DayPartitionType {
+		return nil, fmt.Errorf("Error creating [%s] BigQuery table: unsupported partition type %s. Only %s is supported", tableSchema.Name, partitioning.Type, schema.DayPartitionType)
+	}
+
+	if partitioning.Field != "" {
+		column, ok := tableSchema.Columns[partitioning.Field]
+		if !ok {
+			return nil, fmt.Errorf("Error creating [%s] BigQuery table: partition field %s isn't in the table columns", tableSchema.Name, partitioning.Field)
+		}
+		if column.Type != schema.TIMESTAMP {
+			return nil, fmt.Errorf("Error creating [%s] BigQuery table: partition field %s must be %s, not %s", tableSchema.Name, partitioning.Field, schema.TIMESTAMP, column.Type)
+		}
+	}
+
+	return &bigquery.TimePartitioning{Field: partitioning.Field}, nil
+}
+
+//Return google BigQuery clustering by schema.Table clustering fields (order is preserved)
+//or nil if they aren't set. Fields must be table columns and there must be not more than maxClusteringFields
+func clustering(tableSchema *schema.Table) (*bigquery.Clustering, error) {
+	if len(tableSchema.ClusteringFields) == 0 {
+		return nil, nil
+	}
+
+	if len(tableSchema.ClusteringFields) > maxClusteringFields {
+		return nil, fmt.Errorf("Error creating [%s] BigQuery table: %d clustering fields are configured but BigQuery supports not more than %d", tableSchema.Name, len(tableSchema.ClusteringFields), maxClusteringFields)
+	}
+
+	for _, field := range tableSchema.ClusteringFields {
+		if _, ok := tableSchema.Columns[field]; !ok {
+			return nil, fmt.Errorf("Error creating [%s] BigQuery table: clustering field %s isn't in the table columns", tableSchema.Name, field)
+		}
+	}
+
+	return &bigquery.Clustering{Fields: append([]string{}, tableSchema.ClusteringFields...)}, nil
+}
+
+//Return google cloud storage files reference with configured source format (JSON by default)
+//CSV options (skip leading rows, field delimiter, jagged rows, quoted newlines) are applied only to csv format
+func (bq *BigQuery) gcsReference(fileKeys ...string) (*bigquery.GCSReference, error) {
+	format, err := sourceFormat(bq.config.SourceFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for _, fileKey := range fileKeys {
+		uris = append(uris, fmt.Sprintf("gs://%s/%s", bq.config.Bucket, fileKey))
+	}
+
+	gcsRef := bigquery.NewGCSReference(uris...)
+	gcsRef.SourceFormat = format
+	if format == bigquery.CSV {
+		gcsRef.SkipLeadingRows = bq.config.CSVSkipLeadingRows
+		if bq.config.CSVFieldDelimiter != "" {
+			gcsRef.FieldDelimiter = bq.config.CSVFieldDelimiter
+		}
+		gcsRef.AllowJaggedRows = bq.config.CSVAllowJaggedRows
+		gcsRef.AllowQuotedNewlines = bq.config.CSVAllowQuotedNewlines
+	}
+
+	return gcsRef, nil
+}
+
+//Return standard SQL identifier of google BigQuery table e.g. `project.dataset.table`
+func tableIdentifier(table *bigquery.Table) string {
+	return fmt.Sprintf("`%s.%s.%s`", table.ProjectID, table.DatasetID, table.TableID)
+}
+
+//Return query of max column value (with maxValueAlias name)
+func maxColumnValueQuery(table, column string) string {
+	return fmt.Sprintf("SELECT MAX(`%s`) AS %s FROM %s", column, maxValueAlias, table)
+}
+
+//Return query result row with BigQuery values converted to Go values
+func queryRow(row map[string]bigquery.Value) map[string]interface{} {
+	result := map[string]interface{}{}
+	for name, value := range row {
+		result[name] = queryValue(value)
+	}
+
+	return result
+}
+
+//Return Go value of BigQuery value: REPEATED and RECORD values are converted recursively
+func queryValue(value bigquery.Value) interface{} {
+	switch v := value.(type) {
+	case []bigquery.Value:
+		var values []interface{}
+		for _, item := range v {
+			values = append(values, queryValue(item))
+		}
+		return values
+	case map[string]bigquery.Value:
+		return queryRow(v)
+	default:
+		return v
+	}
+}
+
+//Return MERGE statement which updates target rows matched by keyColumns with updateColumns staging values
+//and inserts not matched staging rows (all columns). Rows are only inserted if updateColumns is empty
+func mergeQuery(target, staging string, keyColumns, updateColumns, columns []string) string {
+	var conditions []string
+	for _, column := range keyColumns {
+		conditions = append(conditions, fmt.Sprintf("T.`%s` = S.`%s`", column, column))
+	}
+
+	var updates []string
+	for _, column := range updateColumns {
+		updates = append(updates, fmt.Sprintf("`%s` = S.`%s`", column, column))
+	}
+
+	var insertColumns, insertValues []string
+	for _, column := range columns {
+		insertColumns = append(insertColumns, fmt.Sprintf("`%s`", column))
+		insertValues = append(insertValues, fmt.Sprintf("S.`%s`", column))
+	}
+
+	query := fmt.Sprintf("MERGE %s T USING %s S ON %s", target, staging, strings.Join(conditions, " AND "))
+	if len(updates) > 0 {
+		query += " WHEN MATCHED THEN UPDATE SET " + strings.Join(updates, ", ")
+	}
+	query += fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s)", strings.Join(insertColumns, ", "), strings.Join(insertValues, ", "))
+
+	return query
+}
+
+//Return INSERT statement which inserts into target only one staging row per keyColumns values:
+//the first one ordered by orderColumns descending (arbitrary one if orderColumns is empty)
+func dedupInsertQuery(target, staging string, keyColumns, orderColumns, columns []string) string {
+	var partition []string
+	for _, column := range keyColumns {
+		partition = append(partition, fmt.Sprintf("`%s`", column))
+	}
+
+	var order []string
+	for _, column := range orderColumns {
+		order = append(order, fmt.Sprintf("`%s` DESC", column))
+	}
+
+	var quotedColumns []string
+	for _, column := range columns {
+		quotedColumns = append(quotedColumns, fmt.Sprintf("`%s`", column))
+	}
+
+	window := "PARTITION BY " + strings.Join(partition, ", ")
+	if len(order) > 0 {
+		window += " ORDER BY " + strings.Join(order, ", ")
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM (SELECT *, ROW_NUMBER() OVER (%s) AS %s FROM %s) WHERE %s = 1",
+		target, strings.Join(quotedColumns, ", "), strings.Join(quotedColumns, ", "), window, rowNumberAlias, staging, rowNumberAlias)
+}
+
+//Return google BigQuery table handle from configured dataset
+//dataset and table names are normalized according to GoogleConfig.NameCase
+func (bq *BigQuery) table(tableName string) *bigquery.Table {
+	return bq.client.Dataset(normalizeName(bq.config.Dataset, bq.config.NameCase)).Table(normalizeName(tableName, bq.config.NameCase))
+}
+
+//Return load job labels: automatic labels of table handle (normalized) names merged with configured ones
+//(configured labels take precedence). All keys and values are sanitized according to BigQuery label rules
+func (bq *BigQuery) loadLabels(table *bigquery.Table) map[string]string {
+	labels := map[string]string{
+		"table":   sanitizeLabel(table.TableID),
+		"dataset": sanitizeLabel(table.DatasetID),
+	}
+	for k, v := range bq.config.LoadLabels {
+		key := sanitizeLabelKey(k)
+		if key == "" {
+			log.Printf("Warn: BigQuery load label %q is skipped: key is empty after sanitizing", k)
+			continue
+		}
+		labels[key] = sanitizeLabel(v)
+	}
+
+	return labels
+}
+
+//Return sanitized label key (see sanitizeLabel) which starts with a lowercase letter:
+//keys which start with a digit, '_' or '-' are prefixed with labelKeyPrefix
+//Return empty string if the key is empty after sanitizing (such key can't be used)
+func sanitizeLabelKey(key string) string {
+	sanitized := sanitizeLabel(strings.TrimSpace(key))
+	if sanitized == "" {
+		return ""
+	}
+
+	if first := []rune(sanitized)[0]; !unicode.IsLetter(first) {
+		return sanitizeLabel(labelKeyPrefix + sanitized)
+	}
+
+	return sanitized
+}
+
+//Return lowercased value where all characters except letters, digits, underscores and dashes are replaced with '_'
+//value is truncated to max label length (63)
+func sanitizeLabel(value string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, value)
+
+	runes := []rune(sanitized)
+	if len(runes) > maxLabelLength {
+		return string(runes[:maxLabelLength])
+	}
+
+	return sanitized
+}
+
+//Return name in configured case: lower, upper or as is
+func normalizeName(name, nameCase string) string {
+	switch nameCase {
+	case LowerNameCase:
+		return strings.ToLower(name)
+	case UpperNameCase:
+		return strings.ToUpper(name)
+	default:
+		return name
+	}
+}
+
+//Return true if sql is one SELECT statement (optionally with WITH clause)
+//Leading comments are skipped. Multi-statement scripts (semicolon isn't only at the end) aren't SELECT statements
+//even if semicolon is inside a string literal: it is conservative check for read-only mode
+func isSelectStatement(sql string) bool {
+	statement := strings.TrimSpace(sql)
+	for {
+		if strings.HasPrefix(statement, "--") || strings.HasPrefix(statement, "#") {
+			end := strings.Index(statement, "\n")
+			if end < 0 {
+				return false
+			}
+			statement = strings.TrimSpace(statement[end+1:])
+		} else if strings.HasPrefix(statement, "/*") {
+			end := strings.Index(statement, "*/")
+			if end < 0 {
+				return false
+			}
+			statement = strings.TrimSpace(statement[end+2:])
+		} else {
+			break
+		}
+	}
+
+	statement = strings.TrimSpace(strings.TrimSuffix(statement, ";"))
+	if strings.Contains(statement, ";") {
+		return false
+	}
+
+	statement = strings.TrimLeft(statement, "( \t\r\n")
+	words := strings.FieldsFunc(statement, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '('
+	})
+	if len(words) == 0 {
+		return false
+	}
+
+	keyword := strings.ToUpper(words[0])
+	return keyword == "SELECT" || keyword == "WITH"
+}
+
+//Return unique google BigQuery job id with prefix
+func newJobID(prefix string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("Error generating BigQuery job id: %v", err)
+	}
+
+	return "eventnative_" + prefix + "_" + hex.EncodeToString(random), nil
+}
+
+//Return true if google err is 404
+func isNotFoundErr(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+//Return schema.Mode of google BigQuery field
+func columnMode(field *bigquery.FieldSchema) schema.Mode {
+	switch {
+	case field.Repeated:
+		return schema.REPEATED
+	case field.Required:
+		return schema.REQUIRED
+	default:
+		return schema.NULLABLE
+	}
+}
+
+//Return true if err is google api 409 (e.g. dataset or table already exists)
+func isAlreadyExistsErr(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusConflict
+}
+
+//Return true if err is google api 404 or BigQuery job error with notFound reason
+func isTableNotFoundErr(err error) bool {
+	if isNotFoundErr(err) {
+		return true
+	}
+
+	e, ok := err.(*bigquery.Error)
+	return ok && e.Reason == "notFound"
+}
+
+//Return true if err (or wrapped one) is transient google BigQuery error:
+//google api 500, 502, 503, 429 or BigQuery job error with backendError/rateLimitExceeded reason
+//e.g. 403 and 404 aren't retryable
+func isRetryableErr(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			return true
+		}
+		return false
+	}
+
+	var jobErr *bigquery.Error
+	if errors.As(err, &jobErr) {
+		return jobErr.Reason == "backendError" || jobErr.Reason == "rateLimitExceeded"
+	}
+
+	return false
+}
+
+//Return true if err (or wrapped one) is a sign of google BigQuery unavailability: transient error (see isRetryableErr)
+//or context deadline. Used by the circuit breaker: caller and data errors (e.g. not found table, invalid values) aren't counted
+func isOutageErr(err error) bool {
+	return isRetryableErr(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+//Return value converted to BigQuery column type (see convertValue)
+//Values of REPEATED columns must be arrays (or nil): they are converted element by element
+func convertFieldValue(value interface{}, field *bigquery.FieldSchema, booleanTokens map[string]bool) (bigquery.Value, error) {
+	if !field.Repeated || value == nil {
+		return convertValue(value, field.Type, booleanTokens)
+	}
+
+	elements := reflect.ValueOf(value)
+	if elements.Kind() != reflect.Slice && elements.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%v (%T) isn't an array of REPEATED %s column", value, value, field.Type)
+	}
+
+	converted := make([]bigquery.Value, elements.Len())
+	for i := 0; i < elements.Len(); i++ {
+		element := elements.Index(i).Interface()
+		//BigQuery arrays can't contain NULL
+		if element == nil {
+			return nil, fmt.Errorf("element %d of REPEATED %s column is null", i, field.Type)
+		}
+		convertedElement, err := convertValue(element, field.Type, booleanTokens)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		converted[i] = convertedElement
+	}
+
+	return converted, nil
+}
+
+//Return value converted to BigQuery column type (according to BigQueryToSchema mapping)
+//Values of unmapped BigQuery types are returned as is
+//String values of BOOLEAN columns are looked up in booleanTokens (case-insensitive) if it isn't nil
+func convertValue(value interface{}, fieldType bigquery.FieldType, booleanTokens map[string]bool) (bigquery.Value, error) {
+	dataType, ok := BigQueryToSchema[fieldType]
+	if !ok || value == nil {
+		return value, nil
+	}
+
+	switch dataType {
+	case schema.STRING:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		return fmt.Sprint(value), nil
+	case schema.INTEGER:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("%v isn't integer", v)
+			}
+			return int64(v), nil
+		case json.Number:
+			return v.Int64()
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		}
+	case schema.FLOAT:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case json.Number:
+			return v.Float64()
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case schema.BOOLEAN:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if booleanTokens == nil {
+				return strconv.ParseBool(v)
+			}
+			b, ok := booleanTokens[strings.ToLower(strings.TrimSpace(v))]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", errUnknownBooleanToken, v)
+			}
+			return b, nil
+		}
+	case schema.TIMESTAMP:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			return time.Parse(timestamp.Layout, v)
+		}
+	}
+
+	return nil, fmt.Errorf("%v (%T) can't be converted to %s", value, value, fieldType)
+}
+
+//Return google BigQuery data format by case-insensitive name (JSON if name is empty)
+func sourceFormat(name string) (bigquery.DataFormat, error) {
+	if name == "" {
+		return bigquery.JSON, nil
+	}
+
+	format, ok := sourceFormats[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("Unknown BigQuery source format(bq_source_format): %s. Supported: json, csv, parquet, avro", name)
+	}
+
+	return format, nil
+}
+
+//Return table name with day partition decorator e.g. events$20200816
+func partitionDecorator(tableName string, partition time.Time) string {
+	return tableName + "$" + partition.UTC().Format("20060102")
+}
+
+//Return table column names: names from columnOrder first (in the same order) and the rest of them sorted
+//Return error if columnOrder contains unknown or duplicated column
+func orderColumns(table *schema.Table, columnOrder []string) ([]string, error) {
+	ordered := map[string]bool{}
+	for _, columnName := range columnOrder {
+		if _, ok := table.Columns[columnName]; !ok {
+			return nil, fmt.Errorf("Error patching %s BigQuery table: ordered column %s isn't in the patch columns", table.Name, columnName)
+		}
+		if ordered[columnName] {
+			return nil, fmt.Errorf("Error patching %s BigQuery table: column %s is ordered twice", table.Name, columnName)
+		}
+		ordered[columnName] = true
+	}
+
+	var rest []string
+	for columnName := range table.Columns {
+		if !ordered[columnName] {
+			rest = append(rest, columnName)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(append([]string{}, columnOrder...), rest...), nil
+}
+
+//Split column names into chunks with size not more than chunkSize
+//Return one chunk with all names if chunkSize isn't positive
+func splitColumns(columnNames []string, chunkSize int) [][]string {
+	if chunkSize <= 0 {
+		chunkSize = len(columnNames)
+	}
+
+	var chunks [][]string
+	for start := 0; start < len(columnNames); start += chunkSize {
+		end := start + chunkSize
+		if end > len(columnNames) {
+			end = len(columnNames)
+		}
+		chunks = append(chunks, columnNames[start:end])
+	}
+
+	return chunks
+}
+
+//Return client credentials options: inline JSON key, key file path or
+//no options if KeyFile is empty (Application Default Credentials e.g. GOOGLE_APPLICATION_CREDENTIALS or GCE/GKE service account)
+func extractCredentials(config *GoogleConfig) []option.ClientOption {
+	if config.KeyFile == "" {
+		return nil
+	}
+
 	if strings.Contains(config.KeyFile, "{") {
-		return option.WithCredentialsJSON([]byte(config.KeyFile))
+		return []option.ClientOption{option.WithCredentialsJSON([]byte(config.KeyFile))}
 	} else {
-		return option.WithCredentialsFile(config.KeyFile)
+		return []option.ClientOption{option.WithCredentialsFile(config.KeyFile)}
 	}
 }
@@ -0,0 +1,1879 @@
+package adapters
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ksensehq/eventnative/schema"
+	"github.com/ksensehq/eventnative/test"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+//job which is done after doneAfter Status calls or when clock reaches doneAt (if clock is set)
+type fakeJob struct {
+	statusCalls int
+	doneAfter   int
+
+	clock  Clock
+	doneAt time.Time
+}
+
+func (fj *fakeJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	return &bigquery.JobStatus{State: bigquery.Done}, nil
+}
+
+func (fj *fakeJob) Status(ctx context.Context) (*bigquery.JobStatus, error) {
+	fj.statusCalls++
+	if fj.clock != nil && !fj.clock.Now().Before(fj.doneAt) {
+		return &bigquery.JobStatus{State: bigquery.Done}, nil
+	}
+	if fj.doneAfter > 0 && fj.statusCalls >= fj.doneAfter {
+		return &bigquery.JobStatus{State: bigquery.Done}, nil
+	}
+	return &bigquery.JobStatus{State: bigquery.Running}, nil
+}
+
+func TestSplitColumns(t *testing.T) {
+	tests := []struct {
+		name           string
+		columnNames    []string
+		chunkSize      int
+		expectedChunks [][]string
+	}{
+		{
+			"Empty columns",
+			[]string{},
+			2,
+			nil,
+		},
+		{
+			"Unlimited chunk size",
+			[]string{"col1", "col2", "col3"},
+			0,
+			[][]string{{"col1", "col2", "col3"}},
+		},
+		{
+			"Columns less than chunk size",
+			[]string{"col1", "col2"},
+			5,
+			[][]string{{"col1", "col2"}},
+		},
+		{
+			"Columns more than chunk size",
+			[]string{"col1", "col2", "col3", "col4", "col5"},
+			2,
+			[][]string{{"col1", "col2"}, {"col3", "col4"}, {"col5"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test.ObjectsEqual(t, tt.expectedChunks, splitColumns(tt.columnNames, tt.chunkSize), "Column chunks aren't equal")
+		})
+	}
+}
+
+func TestPartitionDecorator(t *testing.T) {
+	partition := time.Date(2020, 8, 16, 23, 30, 0, 0, time.UTC)
+	test.ObjectsEqual(t, "events$20200816", partitionDecorator("events", partition), "Decorated table names aren't equal")
+
+	//converted to UTC
+	partition = time.Date(2020, 8, 17, 1, 30, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	test.ObjectsEqual(t, "events$20200816", partitionDecorator("events", partition), "Decorated table names aren't equal")
+}
+
+type testRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+//Return BigQuery adapter which http client responds to all requests with status code and body
+//and pointer to sent requests
+func newTestBigQuery(t *testing.T, config *GoogleConfig, statusCode int, body string) (*BigQuery, *[]testRequest) {
+	return newTestBigQueryWithHandler(t, config, func(testRequest) (int, string) { return statusCode, body })
+}
+
+//Return BigQuery adapter which http client responds to requests with handler status code and body
+//and pointer to sent requests
+func newTestBigQueryWithHandler(t *testing.T, config *GoogleConfig, handler func(testRequest) (int, string)) (*BigQuery, *[]testRequest) {
+	var requests []testRequest
+	mutex := sync.Mutex{}
+	httpClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var reqBody []byte
+		if req.Body != nil {
+			reqBody, _ = ioutil.ReadAll(req.Body)
+		}
+		request := testRequest{method: req.Method, path: req.URL.Path, header: req.Header, body: string(reqBody)}
+		mutex.Lock()
+		requests = append(requests, request)
+		mutex.Unlock()
+
+		statusCode, body := handler(request)
+		return &http.Response{
+			StatusCode: statusCode,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			Request:    req,
+		}, nil
+	})}
+
+	bq, err := NewBigQuery(context.Background(), config, option.WithHTTPClient(httpClient))
+	require.NoError(t, err)
+
+	return bq, &requests
+}
+
+func TestNewBigQueryClientOptions(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusNotFound, `{"error":{"code":404,"message":"Not found"}}`)
+	defer bq.Close()
+
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.Nil(t, table, "Not existing table must be nil")
+	require.Equal(t, 1, len(*requests), "Custom http client wasn't used")
+}
+
+func TestGetTableSchemaWithoutColumns(t *testing.T) {
+	bq, _ := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE"}`)
+	defer bq.Close()
+
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.NotNil(t, table, "Existing table without schema mustn't be nil")
+	test.ObjectsEqual(t, &schema.Table{Name: "events", Columns: schema.Columns{}}, table, "Tables aren't equal")
+	require.False(t, table.Exists())
+}
+
+func TestNameCaseNormalization(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "Test_Dataset", NameCase: LowerNameCase}, http.StatusNotFound, `{"error":{"code":404,"message":"Not found"}}`)
+	defer bq.Close()
+
+	tableSchema := &schema.Table{Name: "Events", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}}
+	_, err := bq.GetTableSchema(tableSchema.Name)
+	require.NoError(t, err)
+	//not found errors
+	require.Error(t, bq.CreateTable(tableSchema))
+	require.Error(t, bq.PatchTableSchema(tableSchema))
+
+	require.True(t, len(*requests) >= 3)
+	for _, req := range *requests {
+		require.True(t, strings.Contains(req.path, "/datasets/test_dataset/"), "Dataset name isn't normalized: %s", req.path)
+		require.False(t, strings.Contains(req.path, "Events"), "Table name isn't normalized: %s", req.path)
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	require.Equal(t, "events", normalizeName("Events", LowerNameCase))
+	require.Equal(t, "EVENTS", normalizeName("Events", UpperNameCase))
+	require.Equal(t, "Events", normalizeName("Events", PreserveNameCase))
+	require.Equal(t, "Events", normalizeName("Events", ""))
+}
+
+func TestLoadLabels(t *testing.T) {
+	bq, _ := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "Events.Dataset", NameCase: UpperNameCase,
+		LoadLabels: map[string]string{"team": "Analytics", "Cost Center": "42", "1env": "prod", "": "skipped"}}, http.StatusOK, "{}")
+	defer bq.Close()
+
+	expected := map[string]string{
+		"table":       "events_20200816",
+		"dataset":     "events_dataset",
+		"team":        "analytics",
+		"cost_center": "42",
+		"label_1env":  "prod",
+	}
+	test.ObjectsEqual(t, expected, bq.loadLabels(bq.table("Events$20200816")), "Load labels aren't equal")
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	require.Equal(t, "user_events_2020-08", sanitizeLabel("User.Events_2020-08"))
+	require.Equal(t, 63, len(sanitizeLabel(strings.Repeat("a", 100))))
+}
+
+func TestSanitizeLabelKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{"valid key", "team", "team"},
+		{"uppercase key", "Cost Center", "cost_center"},
+		{"leading digit", "1env", "label_1env"},
+		{"leading underscore", "_x", "label__x"},
+		{"leading dash", "-x", "label_-x"},
+		{"leading invalid character", ".env", "label__env"},
+		{"empty key", "", ""},
+		{"whitespace key", "  ", ""},
+		{"long key with prefix", "1" + strings.Repeat("a", 100), "label_1" + strings.Repeat("a", 56)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, sanitizeLabelKey(tt.key))
+		})
+	}
+}
+
+func TestIsTableNotFoundErr(t *testing.T) {
+	require.True(t, isTableNotFoundErr(&googleapi.Error{Code: http.StatusNotFound}))
+	require.True(t, isTableNotFoundErr(&bigquery.Error{Reason: "notFound", Message: "Not found: Table project:dataset.events"}))
+	require.False(t, isTableNotFoundErr(&googleapi.Error{Code: http.StatusForbidden}))
+	require.False(t, isTableNotFoundErr(&bigquery.Error{Reason: "invalid"}))
+	require.False(t, isTableNotFoundErr(errors.New("some error")))
+}
+
+func TestIsRetryableErr(t *testing.T) {
+	require.True(t, isRetryableErr(&googleapi.Error{Code: http.StatusInternalServerError}))
+	require.True(t, isRetryableErr(&googleapi.Error{Code: http.StatusBadGateway}))
+	require.True(t, isRetryableErr(&googleapi.Error{Code: http.StatusServiceUnavailable}))
+	require.True(t, isRetryableErr(&googleapi.Error{Code: http.StatusTooManyRequests}))
+	require.True(t, isRetryableErr(fmt.Errorf("Error loading: %w", &bigquery.Error{Reason: "backendError"})))
+	require.False(t, isRetryableErr(&googleapi.Error{Code: http.StatusNotFound}))
+	require.False(t, isRetryableErr(&googleapi.Error{Code: http.StatusForbidden}))
+	require.False(t, isRetryableErr(&bigquery.Error{Reason: "invalid"}))
+	require.False(t, isRetryableErr(errors.New("some error")))
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		statusCode       int
+		expectedRequests int
+	}{
+		{"retryable error", http.StatusInternalServerError, 3},
+		{"non-retryable error", http.StatusForbidden, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Retries: 2, RetryDelay: time.Millisecond},
+				tt.statusCode, `{"error":{"code":`+strconv.Itoa(tt.statusCode)+`,"message":"error"}}`)
+			defer bq.Close()
+
+			err := bq.CreateTable(&schema.Table{Name: "events", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}})
+			require.Error(t, err)
+			require.Equal(t, tt.expectedRequests, len(*requests))
+		})
+	}
+}
+
+func TestFieldSchemaDescriptions(t *testing.T) {
+	bq := &BigQuery{config: &GoogleConfig{ColumnDescriptions: map[string]string{"user_id": "Unique user identifier"}}}
+
+	test.ObjectsEqual(t, &bigquery.FieldSchema{Name: "user_id", Type: bigquery.StringFieldType, Description: "Unique user identifier"},
+		bq.fieldSchema("user_id", schema.Column{Type: schema.STRING}), "Field schemas aren't equal")
+	test.ObjectsEqual(t, &bigquery.FieldSchema{Name: "event_type", Type: bigquery.StringFieldType},
+		bq.fieldSchema("event_type", schema.Column{Type: schema.STRING}), "Field schemas aren't equal")
+}
+
+func TestWaitJobPollInterval(t *testing.T) {
+	//default client cadence
+	bq := &BigQuery{ctx: context.Background(), config: &GoogleConfig{}, clock: realClock{}}
+	job := &fakeJob{}
+	jobStatus, err := bq.waitJob(job)
+	require.NoError(t, err)
+	require.True(t, jobStatus.Done())
+	require.Equal(t, 0, job.statusCalls)
+
+	//done after 3 polls
+	clock := newFakeClock()
+	start := clock.Now()
+	bq = &BigQuery{ctx: context.Background(), config: &GoogleConfig{JobPollInterval: time.Second}, clock: clock}
+	job = &fakeJob{doneAfter: 3}
+	jobStatus, err = bq.waitJob(job)
+	require.NoError(t, err)
+	require.True(t, jobStatus.Done())
+	require.Equal(t, 3, job.statusCalls)
+	require.Equal(t, 2*time.Second, clock.Now().Sub(start), "Job status must be polled every poll interval")
+
+	//short interval polls more frequently than long one during the same time
+	pollsCount := func(interval time.Duration) int {
+		clock := newFakeClock()
+		bq := &BigQuery{ctx: context.Background(), config: &GoogleConfig{JobPollInterval: interval}, clock: clock}
+		job := &fakeJob{clock: clock, doneAt: clock.Now().Add(100 * time.Millisecond)}
+		_, err := bq.waitJob(job)
+		require.NoError(t, err)
+		return job.statusCalls
+	}
+	require.Equal(t, 21, pollsCount(5*time.Millisecond))
+	require.Equal(t, 3, pollsCount(50*time.Millisecond))
+
+	//context cancellation stops polling
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bq = &BigQuery{ctx: ctx, config: &GoogleConfig{JobPollInterval: time.Second}, clock: newFakeClock()}
+	_, err = bq.waitJob(&fakeJob{})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", ReadOnly: true}, http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE"}`)
+	defer bq.Close()
+
+	tableSchema := &schema.Table{Name: "events", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}}
+	require.Equal(t, ErrReadOnly, bq.Copy("file", tableSchema.Name))
+	require.Equal(t, ErrReadOnly, bq.CreateTable(tableSchema))
+	require.Equal(t, ErrReadOnly, bq.CreateDataset("test_dataset"))
+	require.Equal(t, ErrReadOnly, bq.PatchTableSchema(tableSchema))
+	require.Equal(t, ErrReadOnly, bq.Insert(tableSchema.Name, []map[string]interface{}{{"col1": "value"}}))
+	require.Equal(t, ErrReadOnly, bq.Upsert([]string{"file"}, tableSchema.Name, []string{"col1"}, nil))
+	require.Equal(t, ErrReadOnly, bq.TruncateTable(tableSchema.Name))
+	require.Equal(t, ErrReadOnly, bq.CopyToTemporaryTable([]string{"file"}, tableSchema, time.Hour))
+	require.Equal(t, ErrReadOnly, bq.CopyDeduplicated([]string{"file"}, tableSchema.Name, []string{"col1"}, nil))
+	_, err := bq.Query("DELETE FROM test_dataset.events WHERE true")
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, 0, len(*requests), "Mutating operations mustn't send requests")
+
+	table, err := bq.GetTableSchema(tableSchema.Name)
+	require.NoError(t, err)
+	require.NotNil(t, table)
+	require.Equal(t, 1, len(*requests))
+}
+
+func TestIsSelectStatement(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM events", true},
+		{"  select count(*) from events;", true},
+		{"WITH e AS (SELECT * FROM events) SELECT * FROM e", true},
+		{"(SELECT 1) UNION ALL (SELECT 2)", true},
+		{"-- comment\n/* block\ncomment */ SELECT 1", true},
+		{"# comment\nSELECT 1", true},
+		{"DELETE FROM events WHERE true", false},
+		{"INSERT INTO events SELECT * FROM staging", false},
+		{"CREATE TABLE t AS SELECT 1", false},
+		{"SELECT 1; DROP TABLE events", false},
+		{"/* SELECT */ DROP TABLE events", false},
+		{"-- SELECT", false},
+		{"SELECTED", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, isSelectStatement(tt.sql), tt.sql)
+	}
+}
+
+func TestQueryNoRows(t *testing.T) {
+	bq, _ := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", ReadOnly: true, JobPollInterval: time.Millisecond}, http.StatusOK,
+		`{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"query":{"query":"SELECT 1","destinationTable":{"projectId":"test-project","datasetId":"_anonymous","tableId":"results"}}},"status":{"state":"DONE"},"jobComplete":true,"totalRows":"0","schema":{"fields":[{"name":"col1","type":"STRING"}]}}`)
+	defer bq.Close()
+
+	rows, err := bq.Query("SELECT col1 FROM test_dataset.events WHERE false")
+	require.NoError(t, err)
+	require.NotNil(t, rows, "Empty slice must be returned if there are no rows")
+	require.Equal(t, 0, len(rows))
+}
+
+func TestTypeMappingsRoundTrip(t *testing.T) {
+	for _, dataType := range []schema.DataType{schema.STRING, schema.INTEGER, schema.FLOAT, schema.BOOLEAN, schema.TIMESTAMP} {
+		bqType, ok := SchemaToBigQuery[dataType]
+		require.True(t, ok, "Type %s isn't mapped to BigQuery", dataType)
+		require.Equal(t, dataType.String(), string(bqType))
+		require.Equal(t, dataType, BigQueryToSchema[bqType], "Type %s isn't mapped back", dataType)
+	}
+}
+
+func TestGetTableSchemaTypes(t *testing.T) {
+	bq, _ := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[
+{"name":"event_type","type":"STRING"},
+{"name":"revenue","type":"FLOAT"},
+{"name":"items","type":"INTEGER"},
+{"name":"is_new","type":"BOOLEAN"},
+{"name":"_timestamp","type":"TIMESTAMP"},
+{"name":"location","type":"GEOGRAPHY"}]}}`)
+	defer bq.Close()
+
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	expected := &schema.Table{Name: "events", Columns: schema.Columns{
+		"event_type": schema.Column{Type: schema.STRING},
+		"revenue":    schema.Column{Type: schema.FLOAT},
+		"items":      schema.Column{Type: schema.INTEGER},
+		"is_new":     schema.Column{Type: schema.BOOLEAN},
+		"_timestamp": schema.Column{Type: schema.TIMESTAMP},
+		//unknown types are degraded to STRING
+		"location": schema.Column{Type: schema.STRING},
+	}}
+	test.ObjectsEqual(t, expected, table, "Tables aren't equal")
+}
+
+func TestPatchTableSchemaSkipsExistingColumns(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":"etag1","schema":{"fields":[
+{"name":"col1","type":"STRING"},
+{"name":"col2","type":"INTEGER"}]}}`
+
+	tests := []struct {
+		name            string
+		columns         schema.Columns
+		expectedPatch   bool
+		expectedColumns []string
+	}{
+		{
+			"only existing columns",
+			schema.Columns{"col1": schema.Column{Type: schema.STRING}, "COL2": schema.Column{Type: schema.INTEGER}},
+			false,
+			nil,
+		},
+		{
+			"existing and new columns",
+			schema.Columns{
+				"col1": schema.Column{Type: schema.STRING},
+				"col2": schema.Column{Type: schema.INTEGER},
+				"col3": schema.Column{Type: schema.FLOAT},
+				"col4": schema.Column{Type: schema.BOOLEAN},
+			},
+			true,
+			[]string{`"name":"col1"`, `"name":"col2"`, `"name":"col3"`, `"name":"col4"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK, tableResponse)
+			defer bq.Close()
+
+			require.NoError(t, bq.PatchTableSchema(&schema.Table{Name: "events", Columns: tt.columns}))
+
+			var patches []testRequest
+			for _, req := range *requests {
+				if req.method == http.MethodPatch {
+					patches = append(patches, req)
+				}
+			}
+
+			if !tt.expectedPatch {
+				require.Equal(t, 0, len(patches), "Patch request mustn't be sent")
+				return
+			}
+
+			require.Equal(t, 1, len(patches))
+			for _, column := range tt.expectedColumns {
+				require.Equal(t, 1, strings.Count(patches[0].body, column), "Column %s must be sent exactly once", column)
+			}
+		})
+	}
+}
+
+//In-memory google BigQuery table which schema can be requested and patched (with ETag check)
+//Count of concurrently running patch requests is tracked
+type fakeTable struct {
+	mutex   sync.Mutex
+	fields  []map[string]interface{}
+	version int
+
+	patching    int
+	maxPatching int
+}
+
+func (ft *fakeTable) etag() string {
+	return "etag" + strconv.Itoa(ft.version)
+}
+
+func (ft *fakeTable) handle(req testRequest) (int, string) {
+	if req.method == http.MethodPatch {
+		ft.mutex.Lock()
+		ft.patching++
+		if ft.patching > ft.maxPatching {
+			ft.maxPatching = ft.patching
+		}
+		ft.mutex.Unlock()
+		//overlapping patches are caught
+		time.Sleep(time.Millisecond)
+		defer func() {
+			ft.mutex.Lock()
+			ft.patching--
+			ft.mutex.Unlock()
+		}()
+	}
+
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	if req.method == http.MethodPatch {
+		if req.header.Get("If-Match") != ft.etag() {
+			return http.StatusPreconditionFailed, `{"error":{"code":412,"message":"Precondition check failed."}}`
+		}
+		patch := struct {
+			Schema struct {
+				Fields []map[string]interface{} `json:"fields"`
+			} `json:"schema"`
+		}{}
+		if err := json.Unmarshal([]byte(req.body), &patch); err != nil {
+			return http.StatusBadRequest, fmt.Sprintf(`{"error":{"code":400,"message":"%v"}}`, err)
+		}
+		ft.fields = patch.Schema.Fields
+		ft.version++
+	}
+
+	fields, _ := json.Marshal(ft.fields)
+	return http.StatusOK, fmt.Sprintf(`{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":%q,"schema":{"fields":%s}}`, ft.etag(), fields)
+}
+
+//Return table field names
+func (ft *fakeTable) fieldNames() []string {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+
+	var names []string
+	for _, field := range ft.fields {
+		names = append(names, field["name"].(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPatchTableSchemaChunks(t *testing.T) {
+	table := &fakeTable{fields: []map[string]interface{}{{"name": "col0", "type": "STRING"}}}
+	bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", PatchMaxColumns: 2}, table.handle)
+	defer bq.Close()
+
+	patchSchema := &schema.Table{Name: "events", Columns: schema.Columns{}}
+	for i := 1; i <= 5; i++ {
+		patchSchema.Columns["col"+strconv.Itoa(i)] = schema.Column{Type: schema.STRING}
+	}
+	require.NoError(t, bq.PatchTableSchema(patchSchema))
+
+	var patches int
+	for i, req := range *requests {
+		if req.method != http.MethodPatch {
+			continue
+		}
+		patches++
+		require.True(t, i > 0 && (*requests)[i-1].method == http.MethodGet, "Table metadata must be requested before every patch")
+		require.Equal(t, "etag"+strconv.Itoa(patches-1), req.header.Get("If-Match"), "Every patch must be sent with fresh ETag")
+	}
+	require.Equal(t, 3, patches, "5 columns must be added with 3 patches of not more than 2 columns")
+	test.ObjectsEqual(t, []string{"col0", "col1", "col2", "col3", "col4", "col5"}, table.fieldNames(), "All columns must be added")
+}
+
+func TestPatchTableSchemaRequiredColumns(t *testing.T) {
+	table := &fakeTable{fields: []map[string]interface{}{{"name": "col0", "type": "STRING", "mode": "REQUIRED"}}}
+	bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", PatchMaxColumns: 1}, table.handle)
+	defer bq.Close()
+
+	//REQUIRED column is in the last chunk: no chunk must be added
+	err := bq.PatchTableSchema(&schema.Table{Name: "events", Columns: schema.Columns{
+		"col1": schema.Column{Type: schema.STRING},
+		"col2": schema.Column{Type: schema.STRING},
+		"col3": schema.Column{Type: schema.STRING, Mode: schema.REQUIRED},
+	}})
+	require.Error(t, err, "Adding REQUIRED column must be rejected")
+	require.True(t, strings.Contains(err.Error(), "col3"), err.Error())
+	for _, req := range *requests {
+		require.NotEqual(t, http.MethodPatch, req.method, "Patch request mustn't be sent")
+	}
+	test.ObjectsEqual(t, []string{"col0"}, table.fieldNames(), "Columns mustn't be added")
+
+	//existing REQUIRED column is skipped
+	require.NoError(t, bq.PatchTableSchema(&schema.Table{Name: "events", Columns: schema.Columns{
+		"COL0": schema.Column{Type: schema.STRING, Mode: schema.REQUIRED},
+		"col1": schema.Column{Type: schema.STRING},
+	}}))
+	test.ObjectsEqual(t, []string{"col0", "col1"}, table.fieldNames(), "New NULLABLE column must be added")
+}
+
+func TestPatchTableSchemaConcurrency(t *testing.T) {
+	table := &fakeTable{fields: []map[string]interface{}{{"name": "col0", "type": "STRING"}}}
+	//ETag conflicts would be retried: they mustn't happen
+	bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Retries: 3, RetryDelay: time.Millisecond}, table.handle)
+	defer bq.Close()
+
+	expected := []string{"col0"}
+	wg := sync.WaitGroup{}
+	errs := make([]error, 10)
+	for i := 1; i <= 10; i++ {
+		columnName := "col" + strconv.Itoa(i)
+		expected = append(expected, columnName)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i-1] = bq.PatchTableSchema(&schema.Table{Name: "events", Columns: schema.Columns{columnName: schema.Column{Type: schema.STRING}}})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	sort.Strings(expected)
+	test.ObjectsEqual(t, expected, table.fieldNames(), "All columns must be added")
+	require.Equal(t, 1, table.maxPatching, "Patches of the same table mustn't overlap")
+
+	var patches int
+	for _, req := range *requests {
+		if req.method == http.MethodPatch {
+			patches++
+		}
+	}
+	require.Equal(t, 10, patches, "Every column must be added with one patch without ETag conflicts")
+}
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     interface{}
+		fieldType bigquery.FieldType
+		expected  bigquery.Value
+		expectErr bool
+	}{
+		{"string", "value", bigquery.StringFieldType, "value", false},
+		{"number to string", float64(10), bigquery.StringFieldType, "10", false},
+		{"integer", float64(10), bigquery.IntegerFieldType, int64(10), false},
+		{"integer from string", "10", bigquery.IntegerFieldType, int64(10), false},
+		{"fractional integer", 10.5, bigquery.IntegerFieldType, nil, true},
+		{"float", 10.5, bigquery.FloatFieldType, 10.5, false},
+		{"boolean", true, bigquery.BooleanFieldType, true, false},
+		{"wrong boolean", float64(1), bigquery.BooleanFieldType, nil, true},
+		{"timestamp", "2020-08-02T18:23:56.291383Z", bigquery.TimestampFieldType, time.Date(2020, 8, 2, 18, 23, 56, 291383000, time.UTC), false},
+		{"unmapped type", "POINT(1 2)", bigquery.GeographyFieldType, "POINT(1 2)", false},
+		{"nil", nil, bigquery.IntegerFieldType, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := convertValue(tt.value, tt.fieldType, nil)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			test.ObjectsEqual(t, tt.expected, actual, "Converted values aren't equal")
+		})
+	}
+}
+
+func TestConvertFieldValue(t *testing.T) {
+	repeatedIntegers := &bigquery.FieldSchema{Name: "ids", Type: bigquery.IntegerFieldType, Repeated: true}
+	tests := []struct {
+		name      string
+		value     interface{}
+		field     *bigquery.FieldSchema
+		expected  bigquery.Value
+		expectErr bool
+	}{
+		{"not repeated", "10", &bigquery.FieldSchema{Name: "id", Type: bigquery.IntegerFieldType}, int64(10), false},
+		{"repeated", []interface{}{float64(1), "2"}, repeatedIntegers, []bigquery.Value{int64(1), int64(2)}, false},
+		{"repeated typed slice", []string{"1", "2"}, repeatedIntegers, []bigquery.Value{int64(1), int64(2)}, false},
+		{"empty repeated", []interface{}{}, repeatedIntegers, []bigquery.Value{}, false},
+		{"nil repeated", nil, repeatedIntegers, nil, false},
+		{"repeated with wrong element", []interface{}{float64(1), "two"}, repeatedIntegers, nil, true},
+		{"repeated with null element", []interface{}{float64(1), nil}, repeatedIntegers, nil, true},
+		{"repeated scalar", float64(1), repeatedIntegers, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := convertFieldValue(tt.value, tt.field, nil)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			test.ObjectsEqual(t, tt.expected, actual, "Converted values aren't equal")
+		})
+	}
+}
+
+func TestConvertBooleanTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *GoogleConfig
+		trueValues  []string
+		falseValues []string
+	}{
+		{"yes/no", &GoogleConfig{TrueTokens: []string{"yes"}, FalseTokens: []string{"no"}}, []string{"yes", "YES", " Yes "}, []string{"no", "No"}},
+		{"1/0", &GoogleConfig{TrueTokens: []string{"1"}, FalseTokens: []string{"0"}}, []string{"1"}, []string{"0"}},
+		{"true/false", &GoogleConfig{TrueTokens: []string{"true"}, FalseTokens: []string{"false"}}, []string{"true", "True"}, []string{"false", "FALSE"}},
+		{"not configured", &GoogleConfig{}, []string{"true", "1", "T"}, []string{"false", "0", "F"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := tt.config.booleanTokens()
+			for _, value := range tt.trueValues {
+				actual, err := convertValue(value, bigquery.BooleanFieldType, tokens)
+				require.NoError(t, err)
+				require.Equal(t, true, actual, value)
+			}
+			for _, value := range tt.falseValues {
+				actual, err := convertValue(value, bigquery.BooleanFieldType, tokens)
+				require.NoError(t, err)
+				require.Equal(t, false, actual, value)
+			}
+
+			_, err := convertValue("maybe", bigquery.BooleanFieldType, tokens)
+			require.Error(t, err, "Unrecognized token must be an error")
+		})
+	}
+}
+
+func TestInsert(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[
+{"name":"event_type","type":"STRING"},
+{"name":"items","type":"INTEGER"}]}}`
+
+	rowErrorsResponse := `{"insertErrors":[{"index":1,"errors":[{"reason":"invalid","message":"bad row"}]}]}`
+	tests := []struct {
+		name           string
+		skipInvalid    bool
+		insertResponse string
+		expectedErr    string
+	}{
+		{"success", false, `{"kind":"bigquery#tableDataInsertAllResponse"}`, ""},
+		{"row errors", false, rowErrorsResponse, "Error inserting 1 of 2 rows into BigQuery table events: row 1: "},
+		{"row errors with skipping invalid rows", true, rowErrorsResponse, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &GoogleConfig{Project: "test-project", Dataset: "test_dataset", InsertSkipInvalidRows: tt.skipInvalid, InsertIgnoreUnknownValues: tt.skipInvalid}
+			bq, requests := newTestBigQueryWithHandler(t, config, func(req testRequest) (int, string) {
+				if req.method == http.MethodPost {
+					return http.StatusOK, tt.insertResponse
+				}
+				return http.StatusOK, tableResponse
+			})
+			defer bq.Close()
+
+			err := bq.Insert("events", []map[string]interface{}{
+				{"event_type": "user", "items": float64(2), "unknown": "skipped"},
+				{"event_type": "views", "items": "3"},
+			})
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				require.True(t, strings.HasPrefix(err.Error(), tt.expectedErr), err.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			var insertBody string
+			for _, req := range *requests {
+				if req.method == http.MethodPost {
+					insertBody = req.body
+				}
+			}
+			require.True(t, strings.Contains(insertBody, `"items":2`), insertBody)
+			require.True(t, strings.Contains(insertBody, `"items":3`), insertBody)
+			require.False(t, strings.Contains(insertBody, "unknown"), "Columns which aren't in the table must be skipped")
+			require.Equal(t, tt.skipInvalid, strings.Contains(insertBody, `"skipInvalidRows":true`), insertBody)
+			require.Equal(t, tt.skipInvalid, strings.Contains(insertBody, `"ignoreUnknownValues":true`), insertBody)
+		})
+	}
+}
+
+func TestInsertUnknownBooleanTokens(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[
+{"name":"event_type","type":"STRING"},
+{"name":"flag","type":"BOOLEAN"}]}}`
+	rows := []map[string]interface{}{
+		{"event_type": "user", "flag": "yes"},
+		{"event_type": "views", "flag": "maybe"},
+	}
+
+	tests := []struct {
+		name                string
+		policy              string
+		expectedErr         string
+		expectedRows        []string
+		expectedDeadLetters int
+	}{
+		{"error policy", "", "row 1 column flag", nil, 0},
+		{"null policy", NullUnknownBooleanTokenPolicy, "", []string{`{"event_type":"user","flag":true}`, `{"event_type":"views"}`}, 0},
+		{"dead-letter policy", DeadLetterUnknownBooleanTokenPolicy, "", []string{`{"event_type":"user","flag":true}`}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket",
+				TrueTokens: []string{"yes"}, FalseTokens: []string{"no"}, UnknownBooleanTokenPolicy: tt.policy}
+			require.NoError(t, config.Validate())
+			bq, requests := newTestBigQueryWithHandler(t, config, func(req testRequest) (int, string) {
+				if req.method == http.MethodPost {
+					return http.StatusOK, `{"kind":"bigquery#tableDataInsertAllResponse"}`
+				}
+				return http.StatusOK, tableResponse
+			})
+			defer bq.Close()
+			deadLetters := &recordingDeadLetterSink{}
+			bq.SetDeadLetterSink(deadLetters)
+
+			err := bq.Insert("events", rows)
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				require.True(t, strings.Contains(err.Error(), tt.expectedErr), err.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			insertRequest := struct {
+				Rows []struct {
+					Json map[string]interface{} `json:"json"`
+				} `json:"rows"`
+			}{}
+			body := (*requests)[len(*requests)-1].body
+			require.NoError(t, json.Unmarshal([]byte(body), &insertRequest), body)
+			require.Equal(t, len(tt.expectedRows), len(insertRequest.Rows), body)
+			for i, expected := range tt.expectedRows {
+				actual, err := json.Marshal(insertRequest.Rows[i].Json)
+				require.NoError(t, err)
+				test.JsonBytesEqual(t, []byte(expected), actual, "Inserted rows aren't equal")
+			}
+
+			require.Equal(t, tt.expectedDeadLetters, len(deadLetters.letters))
+			if tt.expectedDeadLetters > 0 {
+				test.ObjectsEqual(t, rows[1], deadLetters.letters[0].Row, "Original row must be sent")
+				require.True(t, strings.Contains(deadLetters.letters[0].Reason, "column flag"), deadLetters.letters[0].Reason)
+			}
+		})
+	}
+
+	config := &GoogleConfig{Project: "test-project", Bucket: "test-bucket", UnknownBooleanTokenPolicy: "skip"}
+	require.Error(t, config.Validate(), "Unknown policy must be rejected")
+}
+
+func TestInsertColumnTransform(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[{"name":"email","type":"STRING"}]}}`
+	bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, func(req testRequest) (int, string) {
+		if req.method == http.MethodPost {
+			return http.StatusOK, `{"kind":"bigquery#tableDataInsertAllResponse"}`
+		}
+		return http.StatusOK, tableResponse
+	})
+	defer bq.Close()
+	bq.SetColumnTransform(schema.ColumnTransform{"email": func(v interface{}) (interface{}, error) {
+		if v == "bad" {
+			return nil, errors.New("bad value")
+		}
+		return strings.ToLower(v.(string)), nil
+	}})
+
+	rows := []map[string]interface{}{{"email": "A@B.COM"}}
+	require.NoError(t, bq.Insert("events", rows))
+	require.True(t, strings.Contains((*requests)[len(*requests)-1].body, `"email":"a@b.com"`), (*requests)[len(*requests)-1].body)
+	require.Equal(t, "A@B.COM", rows[0]["email"], "Caller rows mustn't be changed")
+
+	//row with erroring transform is sent to the dead-letter sink, the rest rows are inserted
+	deadLetters := &recordingDeadLetterSink{}
+	bq.SetDeadLetterSink(deadLetters)
+	rows = []map[string]interface{}{{"email": "bad"}, {"email": "C@D.COM"}}
+	require.NoError(t, bq.Insert("events", rows))
+	lastBody := (*requests)[len(*requests)-1].body
+	require.True(t, strings.Contains(lastBody, `"email":"c@d.com"`), lastBody)
+	require.False(t, strings.Contains(lastBody, `"bad"`), lastBody)
+	require.Equal(t, 1, len(deadLetters.letters))
+	test.ObjectsEqual(t, rows[0], deadLetters.letters[0].Row, "Original row must be sent")
+	require.Equal(t, 0, deadLetters.letters[0].RowIndex)
+	require.True(t, strings.Contains(deadLetters.letters[0].Reason, "bad value"), deadLetters.letters[0].Reason)
+}
+
+func TestGCSReference(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            *GoogleConfig
+		expectedFormat    bigquery.DataFormat
+		expectedSkipRows  int64
+		expectedDelimiter string
+		expectedJagged    bool
+		expectedNewlines  bool
+		expectErr         bool
+	}{
+		{"default", &GoogleConfig{Bucket: "bucket"}, bigquery.JSON, 0, "", false, false, false},
+		{"csv", &GoogleConfig{Bucket: "bucket", SourceFormat: "csv", CSVSkipLeadingRows: 1, CSVFieldDelimiter: "|"}, bigquery.CSV, 1, "|", false, false, false},
+		{"csv jagged rows and quoted newlines", &GoogleConfig{Bucket: "bucket", SourceFormat: "csv", CSVAllowJaggedRows: true, CSVAllowQuotedNewlines: true}, bigquery.CSV, 0, "", true, true, false},
+		{"parquet ignores csv options", &GoogleConfig{Bucket: "bucket", SourceFormat: "Parquet", CSVSkipLeadingRows: 1, CSVAllowJaggedRows: true}, bigquery.Parquet, 0, "", false, false, false},
+		{"avro", &GoogleConfig{Bucket: "bucket", SourceFormat: "avro"}, bigquery.Avro, 0, "", false, false, false},
+		{"unknown", &GoogleConfig{Bucket: "bucket", SourceFormat: "xml"}, "", 0, "", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq := &BigQuery{config: tt.config}
+			gcsRef, err := bq.gcsReference("file")
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			test.ObjectsEqual(t, []string{"gs://bucket/file"}, gcsRef.URIs, "URIs aren't equal")
+			require.Equal(t, tt.expectedFormat, gcsRef.SourceFormat)
+			require.Equal(t, tt.expectedSkipRows, gcsRef.SkipLeadingRows)
+			require.Equal(t, tt.expectedDelimiter, gcsRef.FieldDelimiter)
+			require.Equal(t, tt.expectedJagged, gcsRef.AllowJaggedRows)
+			require.Equal(t, tt.expectedNewlines, gcsRef.AllowQuotedNewlines)
+		})
+	}
+}
+
+func TestExtractCredentials(t *testing.T) {
+	require.Empty(t, extractCredentials(&GoogleConfig{}), "Application Default Credentials must be used without key file")
+	require.Equal(t, 1, len(extractCredentials(&GoogleConfig{KeyFile: "key.json"})))
+	require.Equal(t, 1, len(extractCredentials(&GoogleConfig{KeyFile: `{"type":"service_account"}`})))
+}
+
+func TestTimePartitioning(t *testing.T) {
+	columns := schema.Columns{"_timestamp": schema.Column{Type: schema.TIMESTAMP}, "event_type": schema.Column{Type: schema.STRING}}
+	tests := []struct {
+		name         string
+		config       *GoogleConfig
+		partitioning *schema.TimePartitioning
+		expected     *bigquery.TimePartitioning
+		expectErr    bool
+	}{
+		{"not partitioned", &GoogleConfig{}, nil, nil, false},
+		{"ingestion time", &GoogleConfig{IngestionTimePartitioning: true}, nil, &bigquery.TimePartitioning{}, false},
+		{"by column", &GoogleConfig{}, &schema.TimePartitioning{Field: "_timestamp"}, &bigquery.TimePartitioning{Field: "_timestamp"}, false},
+		{"by column with day type", &GoogleConfig{}, &schema.TimePartitioning{Field: "_timestamp", Type: "day"}, &bigquery.TimePartitioning{Field: "_timestamp"}, false},
+		{"unknown column", &GoogleConfig{}, &schema.TimePartitioning{Field: "created_at"}, nil, true},
+		{"not timestamp column", &GoogleConfig{}, &schema.TimePartitioning{Field: "event_type"}, nil, true},
+		{"unsupported type", &GoogleConfig{}, &schema.TimePartitioning{Field: "_timestamp", Type: "MONTH"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq := &BigQuery{config: tt.config}
+			actual, err := bq.timePartitioning(&schema.Table{Name: "events", Columns: columns, Partitioning: tt.partitioning})
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			test.ObjectsEqual(t, tt.expected, actual, "Time partitionings aren't equal")
+		})
+	}
+}
+
+func TestGetTableSchemaPartitioning(t *testing.T) {
+	bq, _ := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE",
+"timePartitioning":{"type":"DAY","field":"_timestamp"},"schema":{"fields":[{"name":"_timestamp","type":"TIMESTAMP"}]}}`)
+	defer bq.Close()
+
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	test.ObjectsEqual(t, &schema.TimePartitioning{Field: "_timestamp", Type: schema.DayPartitionType}, table.Partitioning, "Partitionings aren't equal")
+}
+
+func TestColumnModes(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[
+{"name":"event_type","type":"STRING","mode":"NULLABLE"},
+{"name":"user_id","type":"STRING","mode":"REQUIRED"},
+{"name":"tags","type":"STRING","mode":"REPEATED"}]}}`)
+	defer bq.Close()
+
+	for _, mode := range []schema.Mode{schema.NULLABLE, schema.REQUIRED, schema.REPEATED} {
+		fieldSchema := bq.fieldSchema("column", schema.Column{Type: schema.STRING, Mode: mode})
+		require.Equal(t, mode, columnMode(fieldSchema), "Mode %s isn't mapped back", mode)
+	}
+
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	expected := schema.Columns{
+		"event_type": schema.Column{Type: schema.STRING, Mode: schema.NULLABLE},
+		"user_id":    schema.Column{Type: schema.STRING, Mode: schema.REQUIRED},
+		"tags":       schema.Column{Type: schema.STRING, Mode: schema.REPEATED},
+	}
+	test.ObjectsEqual(t, expected, table.Columns, "Columns aren't equal")
+
+	err = bq.PatchTableSchema(&schema.Table{Name: "events", Columns: schema.Columns{"new_column": schema.Column{Type: schema.STRING, Mode: schema.REQUIRED}}})
+	require.Error(t, err, "Adding REQUIRED column must be rejected")
+	for _, req := range *requests {
+		require.NotEqual(t, http.MethodPatch, req.method, "Patch request mustn't be sent")
+	}
+}
+
+func TestMergeQuery(t *testing.T) {
+	columns := []string{"id", "name", "email", "created_at"}
+	tests := []struct {
+		name          string
+		keyColumns    []string
+		updateColumns []string
+		expected      string
+	}{
+		{
+			"update specified columns",
+			[]string{"id"},
+			[]string{"email"},
+			"MERGE `p.d.users` T USING `p.d.users_staging` S ON T.`id` = S.`id` WHEN MATCHED THEN UPDATE SET `email` = S.`email` " +
+				"WHEN NOT MATCHED THEN INSERT (`id`, `name`, `email`, `created_at`) VALUES (S.`id`, S.`name`, S.`email`, S.`created_at`)",
+		},
+		{
+			"composite key",
+			[]string{"id", "created_at"},
+			[]string{"name", "email"},
+			"MERGE `p.d.users` T USING `p.d.users_staging` S ON T.`id` = S.`id` AND T.`created_at` = S.`created_at` WHEN MATCHED THEN UPDATE SET `name` = S.`name`, `email` = S.`email` " +
+				"WHEN NOT MATCHED THEN INSERT (`id`, `name`, `email`, `created_at`) VALUES (S.`id`, S.`name`, S.`email`, S.`created_at`)",
+		},
+		{
+			"insert only",
+			[]string{"id"},
+			nil,
+			"MERGE `p.d.users` T USING `p.d.users_staging` S ON T.`id` = S.`id` " +
+				"WHEN NOT MATCHED THEN INSERT (`id`, `name`, `email`, `created_at`) VALUES (S.`id`, S.`name`, S.`email`, S.`created_at`)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, mergeQuery("`p.d.users`", "`p.d.users_staging`", tt.keyColumns, tt.updateColumns, columns))
+		})
+	}
+}
+
+func TestDedupInsertQuery(t *testing.T) {
+	columns := []string{"id", "name", "updated_at"}
+	require.Equal(t, "INSERT INTO `p.d.users` (`id`, `name`, `updated_at`) SELECT `id`, `name`, `updated_at` FROM "+
+		"(SELECT *, ROW_NUMBER() OVER (PARTITION BY `id`, `name` ORDER BY `updated_at` DESC) AS _dedup_row_number FROM `p.d.users_staging`) WHERE _dedup_row_number = 1",
+		dedupInsertQuery("`p.d.users`", "`p.d.users_staging`", []string{"id", "name"}, []string{"updated_at"}, columns))
+	require.Equal(t, "INSERT INTO `p.d.users` (`id`, `name`, `updated_at`) SELECT `id`, `name`, `updated_at` FROM "+
+		"(SELECT *, ROW_NUMBER() OVER (PARTITION BY `id`) AS _dedup_row_number FROM `p.d.users_staging`) WHERE _dedup_row_number = 1",
+		dedupInsertQuery("`p.d.users`", "`p.d.users_staging`", []string{"id"}, nil, columns))
+}
+
+func TestCopyDeduplicated(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"users"},"type":"TABLE","schema":{"fields":[
+{"name":"id","type":"STRING"},
+{"name":"name","type":"STRING"},
+{"name":"updated_at","type":"TIMESTAMP"}]}}`
+	jobResponse := `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"query":{"query":"INSERT"}},"status":{"state":"DONE"}}`
+
+	//query job status is polled (instead of waiting for query results)
+	bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket", JobPollInterval: time.Millisecond},
+		func(req testRequest) (int, string) {
+			switch {
+			case req.method == http.MethodDelete:
+				return http.StatusNoContent, ""
+			case strings.Contains(req.path, "/jobs"):
+				return http.StatusOK, jobResponse
+			default:
+				return http.StatusOK, tableResponse
+			}
+		})
+	defer bq.Close()
+
+	require.NoError(t, bq.CopyDeduplicated([]string{"file1", "file2"}, "users", []string{"id"}, []string{"updated_at"}))
+
+	var jobInserts []testRequest
+	var deletes []testRequest
+	for _, req := range *requests {
+		if req.method == http.MethodPost && strings.HasSuffix(req.path, "/jobs") {
+			jobInserts = append(jobInserts, req)
+		}
+		if req.method == http.MethodDelete {
+			deletes = append(deletes, req)
+		}
+	}
+	require.Equal(t, 2, len(jobInserts), "Files must be loaded into staging table and inserted into target with one query")
+	require.True(t, strings.Contains(jobInserts[0].body, "gs://test-bucket/file2") && strings.Contains(jobInserts[0].body, `"tableId":"users_dedup_`), jobInserts[0].body)
+	require.True(t, strings.Contains(jobInserts[1].body, "INSERT INTO `test-project.test_dataset.users`"), jobInserts[1].body)
+	require.True(t, strings.Contains(jobInserts[1].body, "ROW_NUMBER() OVER (PARTITION BY `id` ORDER BY `updated_at` DESC)"), jobInserts[1].body)
+	require.Equal(t, 1, len(deletes), "Staging table must be deleted")
+	require.True(t, strings.Contains(deletes[0].path, "/tables/users_dedup_"), deletes[0].path)
+
+	require.Error(t, bq.CopyDeduplicated([]string{"file1"}, "users", []string{"unknown"}, nil), "Unknown key column must return error")
+	require.Error(t, bq.CopyDeduplicated([]string{"file1"}, "users", nil, nil), "Key columns are required")
+}
+
+func TestCopyFiles(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket"}, http.StatusOK,
+		`{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE"}}`)
+	defer bq.Close()
+
+	require.NoError(t, bq.CopyFiles([]string{"file1", "file2", "file3"}, "events"))
+
+	var jobInserts []testRequest
+	for _, req := range *requests {
+		if req.method == http.MethodPost {
+			jobInserts = append(jobInserts, req)
+		}
+	}
+	require.Equal(t, 1, len(jobInserts), "All files must be loaded with one job")
+	for _, uri := range []string{"gs://test-bucket/file1", "gs://test-bucket/file2", "gs://test-bucket/file3"} {
+		require.True(t, strings.Contains(jobInserts[0].body, uri), "Load job doesn't contain %s", uri)
+	}
+}
+
+func TestCopyFilesChunks(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket"}, http.StatusOK,
+		`{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE"},"statistics":{"load":{"outputRows":"5"}}}`)
+	defer bq.Close()
+	sink := &recordingAuditSink{}
+	bq.SetAuditSink(sink)
+
+	var fileKeys []string
+	for i := 0; i < maxLoadJobSourceURIs+1; i++ {
+		fileKeys = append(fileKeys, fmt.Sprintf("file%d", i))
+	}
+	require.NoError(t, bq.CopyFiles(fileKeys, "events"))
+
+	var jobInserts []testRequest
+	for _, req := range *requests {
+		if req.method == http.MethodPost {
+			jobInserts = append(jobInserts, req)
+		}
+	}
+	require.Equal(t, 2, len(jobInserts), "Files must be loaded with one job per %d files", maxLoadJobSourceURIs)
+	require.Equal(t, maxLoadJobSourceURIs, strings.Count(jobInserts[0].body, "gs://test-bucket/"))
+	require.Equal(t, 1, strings.Count(jobInserts[1].body, "gs://test-bucket/"))
+	require.True(t, strings.Contains(jobInserts[1].body, fmt.Sprintf(`"gs://test-bucket/file%d"`, maxLoadJobSourceURIs)), "The last file must be loaded with the second job")
+
+	require.Equal(t, 2, len(sink.events), "Every load job must be audited")
+	for _, event := range sink.events {
+		require.True(t, event.Success)
+		require.Equal(t, int64(5), event.Rows)
+	}
+}
+
+func TestChunkFileKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileKeys []string
+		expected [][]string
+	}{
+		{"empty", nil, nil},
+		{"less than chunk", []string{"a"}, [][]string{{"a"}}},
+		{"exact chunk", []string{"a", "b"}, [][]string{{"a", "b"}}},
+		{"several chunks", []string{"a", "b", "c", "d", "e"}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test.ObjectsEqual(t, tt.expected, chunkFileKeys(tt.fileKeys, 2))
+		})
+	}
+}
+
+func TestCopyFilesRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		//response to the first status poll of the first job
+		firstPollStatusCode int
+		firstPollBody       string
+		expectedJobs        int
+	}{
+		{"poll error", http.StatusTooManyRequests, `{"error":{"code":429,"message":"Too many requests"}}`, 1},
+		{"failed job", http.StatusOK, `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE","errorResult":{"reason":"backendError","message":"Backend error"}}}`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex := sync.Mutex{}
+			var submittedJobIDs []string
+			createdJobs := map[string]bool{}
+			polls := 0
+			bq, _ := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket",
+				Retries: 2, RetryDelay: time.Millisecond, JobPollInterval: time.Millisecond}, func(req testRequest) (int, string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				if req.method == http.MethodPost {
+					job := struct {
+						JobReference struct {
+							JobID string `json:"jobId"`
+						} `json:"jobReference"`
+					}{}
+					require.NoError(t, json.Unmarshal([]byte(req.body), &job), req.body)
+					submittedJobIDs = append(submittedJobIDs, job.JobReference.JobID)
+					if createdJobs[job.JobReference.JobID] {
+						return http.StatusConflict, `{"error":{"code":409,"message":"Already Exists: Job test-project:` + job.JobReference.JobID + `"}}`
+					}
+					createdJobs[job.JobReference.JobID] = true
+					return http.StatusOK, `{"jobReference":{"projectId":"test-project","jobId":"` + job.JobReference.JobID + `"},"configuration":{"load":{}},"status":{"state":"RUNNING"}}`
+				}
+
+				polls++
+				if polls == 1 {
+					return tt.firstPollStatusCode, tt.firstPollBody
+				}
+				return http.StatusOK, `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE"}}`
+			})
+			defer bq.Close()
+
+			require.NoError(t, bq.CopyFiles([]string{"file1"}, "events"))
+			require.Equal(t, tt.expectedJobs, len(createdJobs), "Load jobs: %v", submittedJobIDs)
+			require.Equal(t, 2, len(submittedJobIDs))
+			if tt.expectedJobs == 1 {
+				require.Equal(t, submittedJobIDs[0], submittedJobIDs[1], "Retry must resubmit the same job")
+			}
+		})
+	}
+}
+
+func TestCopyToTemporaryTable(t *testing.T) {
+	var createBody string
+	bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket"}, func(req testRequest) (int, string) {
+		switch {
+		case req.method == http.MethodGet && strings.Contains(req.path, "/tables/"):
+			return http.StatusNotFound, `{"error":{"code":404,"message":"Not found"}}`
+		case req.method == http.MethodPost && strings.HasSuffix(req.path, "/tables"):
+			createBody = req.body
+			return http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"scratch"},"type":"TABLE"}`
+		default:
+			return http.StatusOK, `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE"}}`
+		}
+	})
+	defer bq.Close()
+
+	start := time.Now()
+	tableSchema := &schema.Table{Name: "scratch", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}}
+	require.NoError(t, bq.CopyToTemporaryTable([]string{"file1"}, tableSchema, time.Hour))
+
+	created := struct {
+		ExpirationTime string `json:"expirationTime"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(createBody), &created), createBody)
+	expirationMillis, err := strconv.ParseInt(created.ExpirationTime, 10, 64)
+	require.NoError(t, err, createBody)
+	expiration := time.Unix(0, expirationMillis*int64(time.Millisecond))
+	require.False(t, expiration.Before(start.Add(time.Hour).Truncate(time.Millisecond)), "Table must expire after configured expiration: %s", expiration)
+	require.False(t, expiration.After(time.Now().Add(time.Hour)), "Table must expire after configured expiration: %s", expiration)
+	require.Equal(t, http.MethodPost, (*requests)[len(*requests)-2].method, "Files must be loaded after table creation")
+
+	require.Error(t, bq.CopyToTemporaryTable([]string{"file1"}, tableSchema, 0), "Expiration must be positive")
+}
+
+func TestTruncateTable(t *testing.T) {
+	tests := []struct {
+		name        string
+		statusCode  int
+		body        string
+		expectedErr error
+	}{
+		{"success", http.StatusOK, `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"query":{"query":"TRUNCATE TABLE"}},"status":{"state":"DONE"}}`, nil},
+		{"table not found", http.StatusNotFound, `{"error":{"code":404,"message":"Not found: Table test-project:test_dataset.events"}}`, ErrTableNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//query job status is polled (instead of waiting for query results)
+			bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", JobPollInterval: time.Millisecond}, tt.statusCode, tt.body)
+			defer bq.Close()
+
+			err := bq.TruncateTable("events")
+			if tt.expectedErr != nil {
+				require.True(t, errors.Is(err, tt.expectedErr), "Expected %v, got %v", tt.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, strings.Contains((*requests)[0].body, "TRUNCATE TABLE `test-project.test_dataset.events`"), (*requests)[0].body)
+		})
+	}
+}
+
+func TestQueryRow(t *testing.T) {
+	timestamp := time.Date(2020, 8, 2, 18, 23, 56, 291383000, time.UTC)
+	row := map[string]bigquery.Value{
+		"event_type": "user",
+		"items":      int64(2),
+		"revenue":    10.5,
+		"is_new":     true,
+		"_timestamp": timestamp,
+		"tags":       []bigquery.Value{"a", "b"},
+		"location":   map[string]bigquery.Value{"city": "New York"},
+		"empty":      nil,
+	}
+	expected := map[string]interface{}{
+		"event_type": "user",
+		"items":      int64(2),
+		"revenue":    10.5,
+		"is_new":     true,
+		"_timestamp": timestamp,
+		"tags":       []interface{}{"a", "b"},
+		"location":   map[string]interface{}{"city": "New York"},
+		"empty":      nil,
+	}
+	test.ObjectsEqual(t, expected, queryRow(row), "Query rows aren't equal")
+}
+
+func TestMaxColumnValueQuery(t *testing.T) {
+	require.Equal(t, "SELECT MAX(`_timestamp`) AS max_value FROM `p.d.events`", maxColumnValueQuery("`p.d.events`", "_timestamp"))
+}
+
+func TestClustering(t *testing.T) {
+	columns := schema.Columns{
+		"user_id":    schema.Column{Type: schema.STRING},
+		"event_type": schema.Column{Type: schema.STRING},
+		"country":    schema.Column{Type: schema.STRING},
+		"city":       schema.Column{Type: schema.STRING},
+		"zip":        schema.Column{Type: schema.STRING},
+	}
+	tests := []struct {
+		name      string
+		fields    []string
+		expected  *bigquery.Clustering
+		expectErr bool
+	}{
+		{"not clustered", nil, nil, false},
+		{"order is preserved", []string{"user_id", "event_type"}, &bigquery.Clustering{Fields: []string{"user_id", "event_type"}}, false},
+		{"reversed order", []string{"event_type", "user_id"}, &bigquery.Clustering{Fields: []string{"event_type", "user_id"}}, false},
+		{"unknown field", []string{"user_id", "session_id"}, nil, true},
+		{"too many fields", []string{"user_id", "event_type", "country", "city", "zip"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := clustering(&schema.Table{Name: "events", Columns: columns, ClusteringFields: tt.fields})
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			test.ObjectsEqual(t, tt.expected, actual, "Clusterings aren't equal")
+		})
+	}
+}
+
+func TestGetTableSchemaClustering(t *testing.T) {
+	bq, _ := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE",
+"clustering":{"fields":["user_id","event_type"]},"schema":{"fields":[{"name":"user_id","type":"STRING"},{"name":"event_type","type":"STRING"}]}}`)
+	defer bq.Close()
+
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	test.ObjectsEqual(t, []string{"user_id", "event_type"}, table.ClusteringFields, "Clustering fields aren't equal")
+}
+
+func TestMetadataCaching(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", MetadataCacheTTL: time.Minute}, http.StatusOK,
+		`{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":"etag1","schema":{"fields":[{"name":"col1","type":"STRING"}]}}`)
+	defer bq.Close()
+	clock := newFakeClock()
+	bq.SetClock(clock)
+
+	tableSchema := &schema.Table{Name: "events", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}}
+	_, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	_, err = bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(*requests), "Cached metadata must be used")
+
+	//table creation checks actual table existence
+	require.NoError(t, bq.CreateTable(tableSchema))
+	require.Equal(t, 2, len(*requests))
+
+	//patch requests actual metadata (and ETag)
+	require.NoError(t, bq.PatchTableSchema(&schema.Table{Name: "events", Columns: schema.Columns{"col2": schema.Column{Type: schema.STRING}}}))
+	require.Equal(t, 4, len(*requests))
+
+	//updated metadata is cached
+	_, err = bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.Equal(t, 4, len(*requests))
+
+	//expired metadata is requested again
+	clock.Advance(time.Minute + time.Second)
+	_, err = bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.Equal(t, 5, len(*requests))
+}
+
+func TestCopyWithSchemaDroppedTable(t *testing.T) {
+	mutex := sync.Mutex{}
+	dropped := false
+	tableCreations := 0
+	bq, _ := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket",
+		MetadataCacheTTL: time.Hour, CreateMissingTables: true}, func(req testRequest) (int, string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		notFound := `{"error":{"code":404,"message":"Not found: Table test-project:test_dataset.events"}}`
+		switch {
+		case req.method == http.MethodPost && strings.HasSuffix(req.path, "/tables"):
+			tableCreations++
+			dropped = false
+			return http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE"}`
+		case strings.Contains(req.path, "/tables/"):
+			if dropped {
+				return http.StatusNotFound, notFound
+			}
+			return http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[{"name":"col1","type":"STRING"}]}}`
+		default:
+			if dropped {
+				return http.StatusNotFound, notFound
+			}
+			return http.StatusOK, `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE"}}`
+		}
+	})
+	defer bq.Close()
+
+	//table metadata is cached and then the table is dropped
+	table, err := bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.NotNil(t, table)
+	mutex.Lock()
+	dropped = true
+	mutex.Unlock()
+
+	tableSchema := &schema.Table{Name: "events", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}}
+	require.NoError(t, bq.CopyWithSchema("file1", tableSchema))
+	require.Equal(t, 1, tableCreations, "Dropped table must be created again")
+
+	//not found error invalidates cached metadata
+	table, err = bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.NotNil(t, table)
+	mutex.Lock()
+	dropped = true
+	mutex.Unlock()
+	require.True(t, errors.Is(bq.Insert("events", []map[string]interface{}{{"col1": "value"}}), ErrTableNotFound))
+	table, err = bq.GetTableSchema("events")
+	require.NoError(t, err)
+	require.Nil(t, table, "Cached metadata of dropped table must be invalidated")
+}
+
+func TestOrderColumns(t *testing.T) {
+	table := &schema.Table{Name: "events", Columns: schema.Columns{
+		"a": schema.Column{Type: schema.STRING},
+		"b": schema.Column{Type: schema.STRING},
+		"c": schema.Column{Type: schema.STRING},
+		"d": schema.Column{Type: schema.STRING},
+	}}
+	tests := []struct {
+		name        string
+		columnOrder []string
+		expected    []string
+		expectErr   bool
+	}{
+		{"without order", nil, []string{"a", "b", "c", "d"}, false},
+		{"full order", []string{"d", "b", "c", "a"}, []string{"d", "b", "c", "a"}, false},
+		{"partial order", []string{"c", "a"}, []string{"c", "a", "b", "d"}, false},
+		{"unknown column", []string{"c", "e"}, nil, true},
+		{"duplicated column", []string{"c", "c"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := orderColumns(table, tt.columnOrder)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			test.ObjectsEqual(t, tt.expected, actual, "Column orders aren't equal")
+		})
+	}
+}
+
+func TestPatchTableSchemaColumnOrder(t *testing.T) {
+	bq, requests := newTestBigQuery(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, http.StatusOK,
+		`{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":"etag1","schema":{"fields":[{"name":"col1","type":"STRING"}]}}`)
+	defer bq.Close()
+
+	patchSchema := &schema.Table{Name: "events", Columns: schema.Columns{
+		"zeta":  schema.Column{Type: schema.STRING},
+		"alpha": schema.Column{Type: schema.STRING},
+		"mu":    schema.Column{Type: schema.STRING},
+	}}
+	require.NoError(t, bq.PatchTableSchema(patchSchema, "zeta", "alpha", "mu"))
+
+	var patchBody string
+	for _, req := range *requests {
+		if req.method == http.MethodPatch {
+			patchBody = req.body
+		}
+	}
+	col1, zeta, alpha, mu := strings.Index(patchBody, `"col1"`), strings.Index(patchBody, `"zeta"`), strings.Index(patchBody, `"alpha"`), strings.Index(patchBody, `"mu"`)
+	require.True(t, col1 >= 0 && col1 < zeta && zeta < alpha && alpha < mu, "Appended fields must follow requested order: %s", patchBody)
+}
+
+func TestBootstrap(t *testing.T) {
+	notFound := `{"error":{"code":404,"message":"Not found"}}`
+	conflict := `{"error":{"code":409,"message":"Already Exists"}}`
+	dataset := `{"datasetReference":{"projectId":"test-project","datasetId":"test_dataset"}}`
+	table := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE"}`
+	tableSchema := &schema.Table{Name: "events", Columns: schema.Columns{"col1": schema.Column{Type: schema.STRING}}}
+
+	tests := []struct {
+		name          string
+		exists        bool
+		bootstraps    int
+		expectedPosts int
+	}{
+		{"cold start", false, 1, 2},
+		{"warm start", true, 1, 0},
+		{"concurrent bootstraps", false, 5, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex := sync.Mutex{}
+			created := map[string]bool{}
+			bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, func(req testRequest) (int, string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				isTable := strings.Contains(req.path, "/tables")
+				body := dataset
+				if isTable {
+					body = table
+				}
+				key := strconv.FormatBool(isTable)
+
+				if req.method == http.MethodPost {
+					//the first creation succeeds, the next ones conflict
+					if created[key] {
+						return http.StatusConflict, conflict
+					}
+					created[key] = true
+					return http.StatusOK, body
+				}
+
+				if tt.exists {
+					return http.StatusOK, body
+				}
+				//concurrent bootstraps see missing dataset and table
+				return http.StatusNotFound, notFound
+			})
+			defer bq.Close()
+
+			wg := sync.WaitGroup{}
+			errs := make([]error, tt.bootstraps)
+			for i := 0; i < tt.bootstraps; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = bq.Bootstrap(tableSchema)
+				}(i)
+			}
+			wg.Wait()
+
+			for _, err := range errs {
+				require.NoError(t, err)
+			}
+			posts := 0
+			for _, req := range *requests {
+				if req.method == http.MethodPost {
+					posts++
+				}
+			}
+			require.Equal(t, tt.expectedPosts, posts)
+		})
+	}
+}
+
+func TestFieldSchemaDefaultDescription(t *testing.T) {
+	bq := &BigQuery{config: &GoogleConfig{
+		ColumnDescriptions:       map[string]string{"user_id": "Unique user identifier"},
+		DefaultColumnDescription: "Auto-created by EventNative on {date}",
+	}, clock: newFakeClock()}
+
+	require.Equal(t, "Unique user identifier", bq.fieldSchema("user_id", schema.Column{Type: schema.STRING}).Description)
+	require.Equal(t, "Auto-created by EventNative on 2020-08-16", bq.fieldSchema("event_type", schema.Column{Type: schema.STRING}).Description)
+}
+
+func TestReconcile(t *testing.T) {
+	tableSchema, err := schema.LoadTableSpec(strings.NewReader(`{"name":"events","columns":[
+{"name":"user_id","type":"STRING"},
+{"name":"event_type","type":"STRING"}],
+"clustering":["user_id"],"labels":{"team":"analytics"}}`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		existingTable  string
+		expectedMethod string
+		expectedBody   []string
+		expectedError  string
+	}{
+		{
+			"table doesn't exist",
+			"",
+			http.MethodPost,
+			[]string{`"clustering":{"fields":["user_id"]}`, `"labels":{"team":"analytics"}`, `"name":"user_id"`, `"name":"event_type"`},
+			"",
+		},
+		{
+			"table exists without some columns",
+			`{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":"etag1","schema":{"fields":[{"name":"user_id","type":"STRING"}]}}`,
+			http.MethodPatch,
+			[]string{`"name":"user_id"`, `"name":"event_type"`},
+			"",
+		},
+		{
+			"existing column type differs",
+			`{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":"etag1","schema":{"fields":[{"name":"user_id","type":"INTEGER"}]}}`,
+			"",
+			nil,
+			"column user_id type is INTEGER but STRING is required",
+		},
+		{
+			"existing column mode differs",
+			`{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","etag":"etag1","schema":{"fields":[{"name":"USER_ID","type":"STRING","mode":"REPEATED"}]}}`,
+			"",
+			nil,
+			"column user_id mode is REPEATED but NULLABLE is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset"}, func(req testRequest) (int, string) {
+				if tt.existingTable == "" && req.method == http.MethodGet {
+					return http.StatusNotFound, `{"error":{"code":404,"message":"Not found"}}`
+				}
+				if tt.existingTable == "" {
+					return http.StatusOK, `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE"}`
+				}
+				return http.StatusOK, tt.existingTable
+			})
+			defer bq.Close()
+
+			err := bq.Reconcile(tableSchema)
+			if tt.expectedError != "" {
+				require.Error(t, err)
+				require.True(t, strings.Contains(err.Error(), tt.expectedError), err.Error())
+				for _, req := range *requests {
+					require.Equal(t, http.MethodGet, req.method, "Table mustn't be changed")
+				}
+				return
+			}
+			require.NoError(t, err)
+
+			var mutations []testRequest
+			for _, req := range *requests {
+				if req.method != http.MethodGet {
+					mutations = append(mutations, req)
+				}
+			}
+			require.Equal(t, 1, len(mutations))
+			require.Equal(t, tt.expectedMethod, mutations[0].method)
+			for _, part := range tt.expectedBody {
+				require.True(t, strings.Contains(mutations[0].body, part), "%s isn't in %s", part, mutations[0].body)
+			}
+		})
+	}
+}
+
+func TestInsertOversizedRows(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[
+{"name":"event_type","type":"STRING"},
+{"name":"payload","type":"STRING"}]}}`
+	rows := []map[string]interface{}{
+		{"event_type": "user", "payload": "small"},
+		{"event_type": "views", "payload": strings.Repeat("x", 200)},
+		{"event_type": "click", "payload": "small"},
+	}
+
+	tests := []struct {
+		name          string
+		policy        string
+		expectErr     bool
+		expectedTypes []string
+	}{
+		{"error policy", "", true, nil},
+		{"skip policy", SkipOversizedRowPolicy, false, []string{"user", "click"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq, requests := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", MaxInsertRowSize: 100, OversizedRowPolicy: tt.policy},
+				func(req testRequest) (int, string) {
+					if req.method == http.MethodPost {
+						return http.StatusOK, `{"kind":"bigquery#tableDataInsertAllResponse"}`
+					}
+					return http.StatusOK, tableResponse
+				})
+			defer bq.Close()
+			deadLetters := &recordingDeadLetterSink{}
+			bq.SetDeadLetterSink(deadLetters)
+
+			err := bq.Insert("events", rows)
+
+			var inserts []testRequest
+			for _, req := range *requests {
+				if req.method == http.MethodPost {
+					inserts = append(inserts, req)
+				}
+			}
+
+			if tt.expectErr {
+				require.Error(t, err)
+				require.Equal(t, 0, len(inserts), "Insert request mustn't be sent")
+				require.Equal(t, 0, len(deadLetters.letters))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 1, len(inserts))
+			for _, eventType := range tt.expectedTypes {
+				require.True(t, strings.Contains(inserts[0].body, `"`+eventType+`"`), inserts[0].body)
+			}
+			require.False(t, strings.Contains(inserts[0].body, "views"), "Oversized row must be skipped")
+
+			require.Equal(t, 1, len(deadLetters.letters), "Oversized row must be sent to the dead-letter sink")
+			letter := deadLetters.letters[0]
+			test.ObjectsEqual(t, rows[1], letter.Row, "Original row must be sent")
+			require.Equal(t, 1, letter.RowIndex)
+			require.Equal(t, "test_dataset", letter.Dataset)
+			require.Equal(t, "events", letter.Table)
+			require.True(t, strings.Contains(letter.Reason, "exceeds max insert row size"), letter.Reason)
+		})
+	}
+}
+
+type recordingDeadLetterSink struct {
+	mutex   sync.Mutex
+	letters []*DeadLetter
+}
+
+func (rdls *recordingDeadLetterSink) Send(letter *DeadLetter) {
+	rdls.mutex.Lock()
+	rdls.letters = append(rdls.letters, letter)
+	rdls.mutex.Unlock()
+}
+
+type recordingAuditSink struct {
+	mutex  sync.Mutex
+	events []*AuditEvent
+}
+
+func (ras *recordingAuditSink) Emit(event *AuditEvent) {
+	ras.mutex.Lock()
+	ras.events = append(ras.events, event)
+	ras.mutex.Unlock()
+}
+
+func TestAuditEvents(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"events"},"type":"TABLE","schema":{"fields":[{"name":"event_type","type":"STRING"}]}}`
+	jobResponse := `{"jobReference":{"projectId":"test-project","jobId":"job1"},"configuration":{"load":{}},"status":{"state":"DONE"},"statistics":{"load":{"outputRows":"3"}}}`
+	notFoundResponse := `{"error":{"code":404,"message":"Not found: Table test-project:test_dataset.events"}}`
+	rows := []map[string]interface{}{{"event_type": "user"}, {"event_type": "views"}}
+
+	tests := []struct {
+		name       string
+		statusCode int
+		operation  func(bq *BigQuery) error
+		expected   *AuditEvent
+	}{
+		{"load success", http.StatusOK, func(bq *BigQuery) error { return bq.Copy("file1", "Events") },
+			&AuditEvent{Principal: "pipeline", Operation: LoadAuditOperation, Dataset: "test_dataset", Table: "events", Rows: 3, JobID: "job1", Success: true}},
+		{"load failure", http.StatusNotFound, func(bq *BigQuery) error { return bq.Copy("file1", "Events") },
+			&AuditEvent{Principal: "pipeline", Operation: LoadAuditOperation, Dataset: "test_dataset", Table: "events"}},
+		{"insert success", http.StatusOK, func(bq *BigQuery) error { return bq.Insert("Events", rows) },
+			&AuditEvent{Principal: "pipeline", Operation: InsertAuditOperation, Dataset: "test_dataset", Table: "events", Rows: 2, Success: true}},
+		{"insert failure", http.StatusNotFound, func(bq *BigQuery) error { return bq.Insert("Events", rows) },
+			&AuditEvent{Principal: "pipeline", Operation: InsertAuditOperation, Dataset: "test_dataset", Table: "events"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq, _ := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "Test_Dataset", NameCase: LowerNameCase, Bucket: "test-bucket", AuditPrincipal: "pipeline"},
+				func(req testRequest) (int, string) {
+					switch {
+					case tt.statusCode != http.StatusOK:
+						return tt.statusCode, notFoundResponse
+					case strings.HasSuffix(req.path, "/insertAll"):
+						return http.StatusOK, `{"kind":"bigquery#tableDataInsertAllResponse"}`
+					case strings.Contains(req.path, "/jobs"):
+						return http.StatusOK, jobResponse
+					default:
+						return http.StatusOK, tableResponse
+					}
+				})
+			defer bq.Close()
+			sink := &recordingAuditSink{}
+			bq.SetAuditSink(sink)
+
+			err := tt.operation(bq)
+
+			require.Equal(t, 1, len(sink.events))
+			actual := sink.events[0]
+			require.False(t, actual.Timestamp.IsZero())
+			if tt.expected.Success {
+				require.NoError(t, err)
+				require.Equal(t, "", actual.Error)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, err.Error(), actual.Error)
+			}
+			actual.Timestamp = time.Time{}
+			actual.Error = ""
+			test.ObjectsEqual(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestStagingAuditEvents(t *testing.T) {
+	tableResponse := `{"tableReference":{"projectId":"test-project","datasetId":"test_dataset","tableId":"users"},"type":"TABLE","schema":{"fields":[
+{"name":"id","type":"STRING"},
+{"name":"updated_at","type":"TIMESTAMP"}]}}`
+	loadResponse := `{"jobReference":{"projectId":"test-project","jobId":"load1"},"configuration":{"load":{}},"status":{"state":"DONE"},"statistics":{"load":{"outputRows":"3"}}}`
+	queryResponse := `{"jobReference":{"projectId":"test-project","jobId":"query1"},"configuration":{"query":{"query":"MERGE"}},"status":{"state":"DONE"},"statistics":{"query":{"numDmlAffectedRows":"2"}}}`
+
+	tests := []struct {
+		name      string
+		operation string
+		run       func(bq *BigQuery) error
+	}{
+		{"upsert", UpsertAuditOperation, func(bq *BigQuery) error {
+			return bq.Upsert([]string{"file1"}, "users", []string{"id"}, []string{"updated_at"})
+		}},
+		{"deduplicated load", DeduplicatedLoadAuditOperation, func(bq *BigQuery) error {
+			return bq.CopyDeduplicated([]string{"file1"}, "users", []string{"id"}, []string{"updated_at"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq, _ := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket", JobPollInterval: time.Millisecond},
+				func(req testRequest) (int, string) {
+					switch {
+					case req.method == http.MethodDelete:
+						return http.StatusNoContent, ""
+					case strings.HasSuffix(req.path, "/jobs") && strings.Contains(req.body, `"load"`), strings.Contains(req.path, "/jobs/load1"):
+						return http.StatusOK, loadResponse
+					case strings.Contains(req.path, "/jobs"):
+						return http.StatusOK, queryResponse
+					default:
+						return http.StatusOK, tableResponse
+					}
+				})
+			defer bq.Close()
+			sink := &recordingAuditSink{}
+			bq.SetAuditSink(sink)
+
+			require.NoError(t, tt.run(bq))
+
+			//staging load and merge/insert query are audited
+			require.Equal(t, 2, len(sink.events))
+			stagingEvent := sink.events[0]
+			require.Equal(t, LoadAuditOperation, stagingEvent.Operation)
+			require.True(t, strings.HasPrefix(stagingEvent.Table, "users_"), stagingEvent.Table)
+			require.Equal(t, "load1", stagingEvent.JobID)
+			require.Equal(t, int64(3), stagingEvent.Rows)
+			require.True(t, stagingEvent.Success)
+
+			event := sink.events[1]
+			require.Equal(t, tt.operation, event.Operation)
+			require.Equal(t, "test_dataset", event.Dataset)
+			require.Equal(t, "users", event.Table)
+			require.Equal(t, "query1", event.JobID)
+			require.Equal(t, int64(2), event.Rows, "Affected rows of the query must be audited")
+			require.True(t, event.Success)
+
+			//failure before staging load is audited as failed operation
+			sink.events = nil
+			require.Error(t, bq.Upsert([]string{"file1"}, "users", []string{"unknown"}, nil))
+			require.Equal(t, 1, len(sink.events))
+			require.Equal(t, UpsertAuditOperation, sink.events[0].Operation)
+			require.False(t, sink.events[0].Success)
+			require.NotEmpty(t, sink.events[0].Error)
+		})
+	}
+}
+
+func TestCircuitBreakerCountsOnlyOutages(t *testing.T) {
+	statusCode := http.StatusNotFound
+	bq, _ := newTestBigQueryWithHandler(t, &GoogleConfig{Project: "test-project", Dataset: "test_dataset", Bucket: "test-bucket", Retries: -1,
+		CircuitBreakerThreshold: 1, CircuitBreakerCooldown: time.Minute}, func(testRequest) (int, string) {
+		return statusCode, fmt.Sprintf(`{"error":{"code":%d,"message":"error"}}`, statusCode)
+	})
+	defer bq.Close()
+
+	for i := 0; i < 3; i++ {
+		err := bq.Copy("file1", "events")
+		require.True(t, errors.Is(err, ErrTableNotFound), "Not found table mustn't open the circuit: %v", err)
+	}
+
+	statusCode = http.StatusTooManyRequests
+	require.Error(t, bq.Copy("file1", "events"))
+	require.Equal(t, ErrCircuitOpen, bq.Copy("file1", "events"), "Unavailable BigQuery must open the circuit")
+}
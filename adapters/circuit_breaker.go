@@ -0,0 +1,155 @@
+package adapters
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var ErrCircuitOpen = errors.New("Circuit breaker is open: destination calls are suspended after consecutive failures")
+
+type circuitState int
+
+func (cs circuitState) String() string {
+	switch cs {
+	default:
+		return ""
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+}
+
+//CircuitBreaker opens after threshold consecutive failures and rejects all calls with ErrCircuitOpen during cooldown.
+//After cooldown it becomes half-open: one probe call is allowed and its result closes or opens the circuit again
+//Only errors matched by isFailure are failures, other errors are registered as successful calls
+//nil CircuitBreaker is valid and executes all calls (disabled breaker)
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	isFailure func(error) bool
+	clock     Clock
+
+	state circuitState
+	//incremented on every state change: results of calls acquired in previous states are ignored
+	generation uint64
+	failures   int
+	openedAt   time.Time
+	probing    bool
+}
+
+//circuitTicket is issued to allowed call by acquire and identifies it in release
+type circuitTicket struct {
+	generation uint64
+	probe      bool
+}
+
+//Return CircuitBreaker or nil if threshold isn't positive
+//All errors are failures if isFailure is nil
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration, isFailure func(error) bool) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	if isFailure == nil {
+		isFailure = func(error) bool { return true }
+	}
+
+	return &CircuitBreaker{name: name, threshold: threshold, cooldown: cooldown, isFailure: isFailure, clock: realClock{}}
+}
+
+//Run f if circuit isn't open and register its result
+//Return ErrCircuitOpen without running f otherwise
+//Panic of f is registered as failure and propagated
+func (cb *CircuitBreaker) Execute(f func() error) (err error) {
+	if cb == nil {
+		return f()
+	}
+
+	ticket, err := cb.acquire()
+	if err != nil {
+		return err
+	}
+
+	failed := true
+	defer func() {
+		cb.release(ticket, failed)
+	}()
+
+	err = f()
+	failed = err != nil && cb.isFailure(err)
+	return err
+}
+
+//Return ticket of the allowed call or ErrCircuitOpen if call isn't allowed
+func (cb *CircuitBreaker) acquire() (circuitTicket, error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.state == circuitOpen {
+		if cb.clock.Now().Sub(cb.openedAt) < cb.cooldown {
+			return circuitTicket{}, ErrCircuitOpen
+		}
+		cb.setState(circuitHalfOpen)
+	}
+
+	ticket := circuitTicket{generation: cb.generation}
+	if cb.state == circuitHalfOpen {
+		//only one probe call at a time
+		if cb.probing {
+			return circuitTicket{}, ErrCircuitOpen
+		}
+		cb.probing = true
+		ticket.probe = true
+	}
+
+	return ticket, nil
+}
+
+//Register result of the call with ticket
+//Only the probe call clears probing flag. Results of calls acquired before the last state change are ignored
+func (cb *CircuitBreaker) release(ticket circuitTicket, failed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if ticket.probe {
+		cb.probing = false
+	}
+	if ticket.generation != cb.generation {
+		return
+	}
+
+	if !failed {
+		cb.failures = 0
+		if cb.state != circuitClosed {
+			cb.setState(circuitClosed)
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = cb.clock.Now()
+		cb.setState(circuitOpen)
+	}
+}
+
+func (cb *CircuitBreaker) setState(state circuitState) {
+	if cb.state != state {
+		log.Printf("%s circuit breaker state: %s -> %s", cb.name, cb.state, state)
+		cb.generation++
+	}
+	cb.state = state
+}
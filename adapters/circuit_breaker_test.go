@@ -0,0 +1,128 @@
+package adapters
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	failed := errors.New("backend error")
+	calls := 0
+	fail := func() error {
+		calls++
+		return failed
+	}
+	succeed := func() error {
+		calls++
+		return nil
+	}
+
+	clock := newFakeClock()
+	cb := NewCircuitBreaker("test", 2, time.Minute, nil)
+	cb.clock = clock
+
+	//closed: failures are passed through until threshold
+	require.Equal(t, failed, cb.Execute(fail))
+	require.Equal(t, circuitClosed, cb.state)
+	require.Equal(t, failed, cb.Execute(fail))
+	require.Equal(t, circuitOpen, cb.state)
+
+	//open: calls are short-circuited
+	require.Equal(t, ErrCircuitOpen, cb.Execute(succeed))
+	require.Equal(t, 2, calls)
+
+	//still open before cooldown end
+	clock.Advance(59 * time.Second)
+	require.Equal(t, ErrCircuitOpen, cb.Execute(succeed))
+	require.Equal(t, 2, calls)
+
+	//half-open: failed probe opens circuit again
+	clock.Advance(time.Second)
+	require.Equal(t, failed, cb.Execute(fail))
+	require.Equal(t, circuitOpen, cb.state)
+	require.Equal(t, ErrCircuitOpen, cb.Execute(succeed))
+	require.Equal(t, 3, calls)
+
+	//half-open: successful probe closes circuit
+	clock.Advance(time.Minute)
+	require.NoError(t, cb.Execute(succeed))
+	require.Equal(t, circuitClosed, cb.state)
+	require.NoError(t, cb.Execute(succeed))
+	require.Equal(t, 5, calls)
+}
+
+func TestDisabledCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker("test", 0, time.Minute, nil)
+	require.Nil(t, cb)
+
+	failed := errors.New("backend error")
+	for i := 0; i < 10; i++ {
+		require.Equal(t, failed, cb.Execute(func() error { return failed }))
+	}
+}
+
+func TestCircuitBreakerIgnoresNotFailures(t *testing.T) {
+	outage := errors.New("backend error")
+	invalid := errors.New("invalid value")
+	cb := NewCircuitBreaker("test", 2, time.Minute, func(err error) bool { return err == outage })
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, invalid, cb.Execute(func() error { return invalid }))
+	}
+	require.Equal(t, circuitClosed, cb.state, "Not failures mustn't open the circuit")
+
+	//not failure resets consecutive failures
+	require.Equal(t, outage, cb.Execute(func() error { return outage }))
+	require.Equal(t, invalid, cb.Execute(func() error { return invalid }))
+	require.Equal(t, outage, cb.Execute(func() error { return outage }))
+	require.Equal(t, circuitClosed, cb.state)
+	require.Equal(t, outage, cb.Execute(func() error { return outage }))
+	require.Equal(t, circuitOpen, cb.state)
+}
+
+func TestCircuitBreakerProbeOwnership(t *testing.T) {
+	failed := errors.New("backend error")
+	clock := newFakeClock()
+	cb := NewCircuitBreaker("test", 1, time.Minute, nil)
+	cb.clock = clock
+
+	//call started in closed state is still running when the circuit is opened and becomes half-open
+	stale, err := cb.acquire()
+	require.NoError(t, err)
+	require.Equal(t, failed, cb.Execute(func() error { return failed }))
+	clock.Advance(time.Minute)
+	probe, err := cb.acquire()
+	require.NoError(t, err)
+	require.True(t, probe.probe)
+
+	//stale call result neither clears probing nor changes the state
+	cb.release(stale, false)
+	require.Equal(t, circuitHalfOpen, cb.state)
+	require.Equal(t, ErrCircuitOpen, cb.Execute(func() error { return nil }), "Only one probe call is allowed")
+
+	cb.release(probe, false)
+	require.Equal(t, circuitClosed, cb.state)
+	require.False(t, cb.probing)
+}
+
+func TestCircuitBreakerProbePanic(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker("test", 1, time.Minute, nil)
+	cb.clock = clock
+
+	require.Error(t, cb.Execute(func() error { return errors.New("backend error") }))
+	clock.Advance(time.Minute)
+
+	//panicked probe is registered as failure and doesn't leave probing set
+	require.Panics(t, func() {
+		cb.Execute(func() error { panic("probe panic") })
+	})
+	require.Equal(t, circuitOpen, cb.state)
+	require.False(t, cb.probing)
+
+	clock.Advance(time.Minute)
+	require.NoError(t, cb.Execute(func() error { return nil }))
+	require.Equal(t, circuitClosed, cb.state)
+}
@@ -0,0 +1,27 @@
+package adapters
+
+import "time"
+
+//Source of the current time and timers (cache TTL, circuit breaker cooldown, retry backoff, job polling, timestamps)
+//Real clock is used by default, tests can replace it with a fake one
+type Clock interface {
+	Now() time.Time
+	//Return channel which receives the current time after duration
+	After(d time.Duration) <-chan time.Time
+}
+
+//Clock of the system time
+type realClock struct{}
+
+//Return clock of the system time
+func NewRealClock() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
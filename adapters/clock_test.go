@@ -0,0 +1,39 @@
+package adapters
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock for tests: time is moved only with Advance and After calls
+//After moves the time by duration and returns already fired channel, so waits don't take real time
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 8, 16, 23, 0, 0, 0, time.UTC)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.Advance(d)
+
+	fired := make(chan time.Time, 1)
+	fired <- fc.Now()
+	return fired
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.now = fc.now.Add(d)
+}
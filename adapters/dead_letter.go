@@ -0,0 +1,26 @@
+package adapters
+
+import "time"
+
+//Row which can't be written into google BigQuery (e.g. oversized or with invalid values) with the reason
+//The rest rows of the batch are written
+type DeadLetter struct {
+	Dataset string
+	Table   string
+	//original row of the caller (before transformations and conversion)
+	Row map[string]interface{}
+	//row index in the caller batch
+	RowIndex  int
+	Reason    string
+	Timestamp time.Time
+}
+
+//Destination of rejected rows (e.g. storage for later inspection and replay). Send must be safe for concurrent use
+type DeadLetterSink interface {
+	Send(letter *DeadLetter)
+}
+
+//Default dead-letter sink which drops all rows
+type noOpDeadLetterSink struct{}
+
+func (noOpDeadLetterSink) Send(*DeadLetter) {}
@@ -5,20 +5,128 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	LowerNameCase    = "lower"
+	UpperNameCase    = "upper"
+	PreserveNameCase = "preserve"
+
+	ErrorOversizedRowPolicy = "error"
+	SkipOversizedRowPolicy  = "skip"
+
+	ErrorUnknownBooleanTokenPolicy      = "error"
+	NullUnknownBooleanTokenPolicy       = "null"
+	DeadLetterUnknownBooleanTokenPolicy = "dead_letter"
+)
+
+var predefinedACLs = map[string]bool{
+	"authenticatedRead":      true,
+	"bucketOwnerFullControl": true,
+	"bucketOwnerRead":        true,
+	"private":                true,
+	"projectPrivate":         true,
+	"publicRead":             true,
+}
+
 type GoogleCloudStorage struct {
 	config *GoogleConfig
 	client *storage.Client
 	ctx    context.Context
+	clock  Clock
+	//bucket existence is checked (and bucket is created) only once if GoogleConfig.CreateBucket
+	bucketMutex  sync.Mutex
+	bucketExists bool
 }
 
 type GoogleConfig struct {
 	Bucket  string `mapstructure:"gcs_bucket"`
 	Project string `mapstructure:"bq_project"`
 	Dataset string `mapstructure:"bq_dataset"`
+	//inline JSON key or key file path. Application Default Credentials are used if empty
 	KeyFile string `mapstructure:"key_file"`
+	//max columns count in one BigQuery table schema update (0 - unlimited)
+	PatchMaxColumns int `mapstructure:"bq_patch_max_columns"`
+	//create tables partitioned by load time (_PARTITIONTIME pseudo column)
+	IngestionTimePartitioning bool `mapstructure:"bq_ingestion_time_partitioning"`
+	//predefined ACL for uploaded objects (only for buckets with fine-grained access control).
+	//Must be empty for buckets with uniform bucket-level access
+	PredefinedACL string `mapstructure:"gcs_predefined_acl"`
+	//additional labels for BigQuery load jobs (table and dataset labels are added automatically)
+	LoadLabels map[string]string `mapstructure:"bq_load_labels"`
+	//consecutive BigQuery failures count after which calls are suspended for cooldown (0 - disabled)
+	CircuitBreakerThreshold int           `mapstructure:"bq_circuit_breaker_threshold"`
+	CircuitBreakerCooldown  time.Duration `mapstructure:"bq_circuit_breaker_cooldown"`
+	//create table from the provided schema and load again if BigQuery table doesn't exist on CopyWithSchema
+	CreateMissingTables bool `mapstructure:"bq_create_missing_tables"`
+	//files bigger than threshold (in bytes) are uploaded with resumable upload by chunks (0 - google client default behavior),
+	//smaller ones are uploaded with one request
+	ResumableUploadThreshold int `mapstructure:"gcs_resumable_upload_threshold"`
+	UploadChunkSize          int `mapstructure:"gcs_upload_chunk_size"`
+	//case of BigQuery dataset and table names: lower, upper or preserve (default)
+	NameCase string `mapstructure:"bq_name_case"`
+	//retries count of failed uploads (negative - disabled) and base delay of exponential backoff between them
+	UploadRetries    int           `mapstructure:"gcs_upload_retries"`
+	UploadRetryDelay time.Duration `mapstructure:"gcs_upload_retry_delay"`
+	//data dictionary: column name -> description. Applied to matching columns of all created and patched tables
+	ColumnDescriptions map[string]string `mapstructure:"bq_column_descriptions"`
+	//interval of BigQuery job status polling (0 - google client default)
+	JobPollInterval time.Duration `mapstructure:"bq_job_poll_interval"`
+	//allow only reading BigQuery schemas: all mutating operations return ErrReadOnly
+	ReadOnly bool `mapstructure:"bq_read_only"`
+	//max count of parallel staging file uploads (0 or 1 - sequential uploads)
+	UploadConcurrency int `mapstructure:"gcs_upload_concurrency"`
+	//retries count of transient BigQuery errors (negative - disabled) and base delay of exponential backoff between them
+	Retries    int           `mapstructure:"bq_retries"`
+	RetryDelay time.Duration `mapstructure:"bq_retry_delay"`
+	//format of files loaded with Copy: json (default), csv, parquet or avro
+	SourceFormat string `mapstructure:"bq_source_format"`
+	//only for csv source format
+	CSVSkipLeadingRows int64  `mapstructure:"bq_csv_skip_leading_rows"`
+	CSVFieldDelimiter  string `mapstructure:"bq_csv_field_delimiter"`
+	//accept rows with missing trailing optional columns (as nulls) and quoted values with newlines
+	CSVAllowJaggedRows     bool `mapstructure:"bq_csv_allow_jagged_rows"`
+	CSVAllowQuotedNewlines bool `mapstructure:"bq_csv_allow_quoted_newlines"`
+	//string values of BOOLEAN columns in streaming inserts (Insert only) e.g. yes/no, 1/0 (case-insensitive)
+	//Unknown tokens are errors. strconv.ParseBool tokens are used if both lists are empty
+	//Files loaded with Copy aren't coerced: they are parsed by BigQuery load jobs on the server side
+	//and staged by the schema processor before table column types are known (all new columns are STRING)
+	TrueTokens  []string `mapstructure:"bq_true_tokens"`
+	FalseTokens []string `mapstructure:"bq_false_tokens"`
+	//unknown boolean tokens policy: error (default, whole insert fails), null (value is written as null)
+	//or dead_letter (row is sent to the dead-letter sink and the rest rows are inserted)
+	UnknownBooleanTokenPolicy string `mapstructure:"bq_unknown_boolean_token_policy"`
+	//create bucket before the first upload if it doesn't exist (requires storage.buckets.create permission)
+	//in configured location (google default if empty) with optional deletion of objects older than lifecycle days
+	CreateBucket                 bool   `mapstructure:"gcs_create_bucket"`
+	BucketLocation               string `mapstructure:"gcs_bucket_location"`
+	BucketLifecycleDeleteAgeDays int64  `mapstructure:"gcs_bucket_lifecycle_delete_age_days"`
+	//TTL of cached BigQuery tables metadata (negative - disabled)
+	MetadataCacheTTL time.Duration `mapstructure:"bq_metadata_cache_ttl"`
+	//description of created and patched columns without bq_column_descriptions entry
+	//{date} is replaced with the current date (UTC, YYYY-MM-DD) e.g. "Auto-created by EventNative on {date}"
+	DefaultColumnDescription string `mapstructure:"bq_default_column_description"`
+	//max serialized row size in bytes for streaming inserts (BigQuery limit 10MB if not positive)
+	//and oversized rows policy: error (default, whole insert fails) or skip (oversized rows are sent to the dead-letter sink
+	//and the rest rows are inserted)
+	MaxInsertRowSize   int    `mapstructure:"bq_max_insert_row_size"`
+	OversizedRowPolicy string `mapstructure:"bq_oversized_row_policy"`
+	//streaming insert options: insert valid rows of the request even if there are invalid ones (they are logged)
+	//and ignore values of columns which aren't in the table instead of failing the row
+	InsertSkipInvalidRows     bool `mapstructure:"bq_insert_skip_invalid_rows"`
+	InsertIgnoreUnknownValues bool `mapstructure:"bq_insert_ignore_unknown_values"`
+	//principal (e.g. service account or pipeline name) written into load and insert audit events
+	AuditPrincipal string `mapstructure:"bq_audit_principal"`
 }
 
 func (gc *GoogleConfig) Validate() error {
@@ -28,41 +136,177 @@ func (gc *GoogleConfig) Validate() error {
 	if gc.Bucket == "" {
 		return errors.New("Google cloud storage bucket(gcs_bucket) is required parameter")
 	}
-	if gc.KeyFile == "" {
-		return errors.New("Google key file is required parameter")
-	}
 	if gc.Project == "" {
 		return errors.New("BigQuery project(bq_project) is required parameter")
 	}
+	switch gc.NameCase {
+	case "", LowerNameCase, UpperNameCase, PreserveNameCase:
+	default:
+		return fmt.Errorf("Unknown BigQuery name case(bq_name_case): %s. Supported: %s, %s, %s", gc.NameCase, LowerNameCase, UpperNameCase, PreserveNameCase)
+	}
+	if gc.PredefinedACL != "" && !predefinedACLs[gc.PredefinedACL] {
+		return fmt.Errorf("Unknown google cloud storage predefined ACL(gcs_predefined_acl): %s", gc.PredefinedACL)
+	}
+	if _, err := sourceFormat(gc.SourceFormat); err != nil {
+		return err
+	}
+	switch strings.ToLower(gc.OversizedRowPolicy) {
+	case "", ErrorOversizedRowPolicy, SkipOversizedRowPolicy:
+	default:
+		return fmt.Errorf("Unknown BigQuery oversized row policy(bq_oversized_row_policy): %s. Supported: %s, %s", gc.OversizedRowPolicy, ErrorOversizedRowPolicy, SkipOversizedRowPolicy)
+	}
+	switch strings.ToLower(gc.UnknownBooleanTokenPolicy) {
+	case "", ErrorUnknownBooleanTokenPolicy, NullUnknownBooleanTokenPolicy, DeadLetterUnknownBooleanTokenPolicy:
+	default:
+		return fmt.Errorf("Unknown BigQuery unknown boolean token policy(bq_unknown_boolean_token_policy): %s. Supported: %s, %s, %s", gc.UnknownBooleanTokenPolicy, ErrorUnknownBooleanTokenPolicy, NullUnknownBooleanTokenPolicy, DeadLetterUnknownBooleanTokenPolicy)
+	}
+	for key := range gc.LoadLabels {
+		if sanitizeLabelKey(key) == "" {
+			return fmt.Errorf("BigQuery load label key(bq_load_labels) %q is invalid: key can't be empty", key)
+		}
+	}
+	for _, falseToken := range gc.FalseTokens {
+		for _, trueToken := range gc.TrueTokens {
+			if strings.EqualFold(strings.TrimSpace(falseToken), strings.TrimSpace(trueToken)) {
+				return fmt.Errorf("BigQuery boolean token %s is both true(bq_true_tokens) and false(bq_false_tokens)", trueToken)
+			}
+		}
+	}
 
 	return nil
 }
 
-func NewGoogleCloudStorage(ctx context.Context, config *GoogleConfig) (*GoogleCloudStorage, error) {
+//Return normalized boolean token -> value or nil if tokens aren't configured
+func (gc *GoogleConfig) booleanTokens() map[string]bool {
+	if len(gc.TrueTokens) == 0 && len(gc.FalseTokens) == 0 {
+		return nil
+	}
+
+	tokens := map[string]bool{}
+	for _, token := range gc.TrueTokens {
+		tokens[strings.ToLower(strings.TrimSpace(token))] = true
+	}
+	for _, token := range gc.FalseTokens {
+		tokens[strings.ToLower(strings.TrimSpace(token))] = false
+	}
+
+	return tokens
+}
+
+//Create google cloud storage adapter
+//Additional client options are applied after credentials
+func NewGoogleCloudStorage(ctx context.Context, config *GoogleConfig, opts ...option.ClientOption) (*GoogleCloudStorage, error) {
 	credentials := extractCredentials(config)
-	client, err := storage.NewClient(ctx, credentials)
+	client, err := storage.NewClient(ctx, append(credentials, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating google cloud storage client: %v", err)
 	}
 
-	return &GoogleCloudStorage{client: client, config: config, ctx: ctx}, nil
+	return &GoogleCloudStorage{client: client, config: config, ctx: ctx, clock: realClock{}}, nil
+}
+
+//Set source of the current time and timers used for upload retries backoff (real clock if nil)
+//Should be called before the adapter usage
+func (gcs *GoogleCloudStorage) SetClock(clock Clock) {
+	if clock == nil {
+		clock = realClock{}
+	}
+	gcs.clock = clock
 }
 
 //Create named file on google cloud storage with payload
+//Upload is retried on transient errors
 func (gcs *GoogleCloudStorage) UploadBytes(fileName string, fileBytes []byte) error {
+	if err := gcs.ensureBucket(); err != nil {
+		return err
+	}
+
+	return retry(gcs.ctx, gcs.clock, gcs.config.UploadRetries, gcs.config.UploadRetryDelay, isRetryableUploadErr, func() error {
+		w := gcs.newWriter(fileName, len(fileBytes))
+
+		if _, err := w.Write(fileBytes); err != nil {
+			return fmt.Errorf("Error writing file to google cloud storage: %w", err)
+		}
+
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("Error closing file writer to google cloud storage: %w", err)
+		}
+
+		return nil
+	})
+}
+
+//Create files on google cloud storage with not more than GoogleConfig.UploadConcurrency parallel uploads
+//Return keys of uploaded files in the same order as files and all upload errors
+func (gcs *GoogleCloudStorage) UploadFiles(files []*StagingFile) ([]string, error) {
+	return uploadFiles(files, gcs.config.UploadConcurrency, gcs.UploadBytes)
+}
+
+//Create configured bucket if GoogleConfig.CreateBucket is set and the bucket doesn't exist
+//Successful check is cached: bucket isn't requested again
+func (gcs *GoogleCloudStorage) ensureBucket() error {
+	if !gcs.config.CreateBucket {
+		return nil
+	}
+
+	gcs.bucketMutex.Lock()
+	defer gcs.bucketMutex.Unlock()
+
+	if gcs.bucketExists {
+		return nil
+	}
+
+	bucket := gcs.client.Bucket(gcs.config.Bucket)
+	if _, err := bucket.Attrs(gcs.ctx); err != nil {
+		if err != storage.ErrBucketNotExist {
+			return fmt.Errorf("Error getting google cloud storage bucket %s: %v", gcs.config.Bucket, err)
+		}
+
+		attrs := &storage.BucketAttrs{Location: gcs.config.BucketLocation}
+		if gcs.config.BucketLifecycleDeleteAgeDays > 0 {
+			attrs.Lifecycle = storage.Lifecycle{Rules: []storage.LifecycleRule{{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: gcs.config.BucketLifecycleDeleteAgeDays},
+			}}}
+		}
+
+		if err := bucket.Create(gcs.ctx, gcs.config.Project, attrs); err != nil {
+			//bucket might be created concurrently e.g. by another instance
+			if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusConflict {
+				return fmt.Errorf("Error creating google cloud storage bucket %s: %v", gcs.config.Bucket, err)
+			}
+		}
+		log.Printf("Google cloud storage bucket %s has been created", gcs.config.Bucket)
+	}
+
+	gcs.bucketExists = true
+	return nil
+}
+
+//Return writer for named file with size in bytes
+//ACL isn't set unless predefined ACL is configured (uniform bucket-level access rejects per-object ACLs)
+//Resumable upload (with retries of failed chunks) is used only for files bigger than configured threshold
+func (gcs *GoogleCloudStorage) newWriter(fileName string, size int) *storage.Writer {
 	bucket := gcs.client.Bucket(gcs.config.Bucket)
 	object := bucket.Object(fileName)
 	w := object.NewWriter(gcs.ctx)
-
-	if _, err := w.Write(fileBytes); err != nil {
-		return fmt.Errorf("Error writing file to google cloud storage: %v", err)
+	if gcs.config.PredefinedACL != "" {
+		w.PredefinedACL = gcs.config.PredefinedACL
 	}
 
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("Error closing file writer to google cloud storage: %v", err)
+	if gcs.config.ResumableUploadThreshold > 0 {
+		if size > gcs.config.ResumableUploadThreshold {
+			w.ChunkSize = gcs.config.UploadChunkSize
+			if w.ChunkSize <= 0 {
+				w.ChunkSize = googleapi.DefaultUploadChunkSize
+			}
+		} else {
+			//upload in a single request
+			w.ChunkSize = 0
+		}
 	}
 
-	return nil
+	return w
 }
 
 //Return google cloud storage bucket file names
@@ -96,6 +340,21 @@ func (gcs *GoogleCloudStorage) DeleteObject(key string) error {
 	return nil
 }
 
+//Return true if err is google api 429 or 5xx error or temporary network error
+func isRetryableUploadErr(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Temporary() || netErr.Timeout()
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 func (gcs *GoogleCloudStorage) Close() error {
 	if err := gcs.client.Close(); err != nil {
 		return fmt.Errorf("Error closing google cloud storage client: %v", err)
@@ -0,0 +1,193 @@
+package adapters
+
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestNewWriterPredefinedACL(t *testing.T) {
+	tests := []struct {
+		name          string
+		predefinedACL string
+	}{
+		{
+			"Uniform bucket-level access",
+			"",
+		},
+		{
+			"Fine-grained access",
+			"bucketOwnerFullControl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, err := storage.NewClient(ctx, option.WithoutAuthentication())
+			require.NoError(t, err)
+			defer client.Close()
+
+			gcs := &GoogleCloudStorage{ctx: ctx, client: client, config: &GoogleConfig{Bucket: "test-bucket", PredefinedACL: tt.predefinedACL}}
+			w := gcs.newWriter("file", 10)
+			require.Equal(t, tt.predefinedACL, w.PredefinedACL)
+			require.Nil(t, w.ACL)
+		})
+	}
+}
+
+func TestGoogleConfigValidatePredefinedACL(t *testing.T) {
+	config := &GoogleConfig{Bucket: "test-bucket", KeyFile: "key.json", Project: "test-project", PredefinedACL: "publicRead"}
+	require.NoError(t, config.Validate())
+
+	config.PredefinedACL = "unknown"
+	require.Error(t, config.Validate())
+}
+
+func TestGoogleConfigValidateWithoutKeyFile(t *testing.T) {
+	config := &GoogleConfig{Bucket: "test-bucket", Project: "test-project"}
+	require.NoError(t, config.Validate(), "Application Default Credentials must be used without key file")
+}
+
+func TestGoogleConfigValidateBooleanTokens(t *testing.T) {
+	config := &GoogleConfig{Bucket: "test-bucket", Project: "test-project", TrueTokens: []string{"yes", "1"}, FalseTokens: []string{"no", "0"}}
+	require.NoError(t, config.Validate())
+
+	config.FalseTokens = append(config.FalseTokens, "YES")
+	require.Error(t, config.Validate())
+}
+
+func TestGoogleConfigValidateLoadLabels(t *testing.T) {
+	config := &GoogleConfig{Bucket: "test-bucket", Project: "test-project", LoadLabels: map[string]string{"1env": "prod", "team": ""}}
+	require.NoError(t, config.Validate())
+
+	config.LoadLabels[" "] = "value"
+	require.Error(t, config.Validate())
+}
+
+func TestGoogleConfigValidateOversizedRowPolicy(t *testing.T) {
+	config := &GoogleConfig{Bucket: "test-bucket", Project: "test-project", OversizedRowPolicy: SkipOversizedRowPolicy}
+	require.NoError(t, config.Validate())
+
+	config.OversizedRowPolicy = "dead_letter"
+	require.Error(t, config.Validate())
+}
+
+func TestGoogleConfigValidateSourceFormat(t *testing.T) {
+	config := &GoogleConfig{Bucket: "test-bucket", KeyFile: "key.json", Project: "test-project", SourceFormat: "csv"}
+	require.NoError(t, config.Validate())
+
+	config.SourceFormat = "xml"
+	require.Error(t, config.Validate())
+}
+
+func TestNewWriterResumableUpload(t *testing.T) {
+	tests := []struct {
+		name              string
+		threshold         int
+		chunkSize         int
+		fileSize          int
+		expectedChunkSize int
+	}{
+		{
+			"Threshold isn't configured",
+			0,
+			0,
+			100,
+			googleapi.DefaultUploadChunkSize,
+		},
+		{
+			"File is smaller than threshold",
+			1024,
+			512,
+			100,
+			0,
+		},
+		{
+			"File is bigger than threshold",
+			1024,
+			512,
+			2048,
+			512,
+		},
+		{
+			"File is bigger than threshold with default chunk size",
+			1024,
+			0,
+			2048,
+			googleapi.DefaultUploadChunkSize,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, err := storage.NewClient(ctx, option.WithoutAuthentication())
+			require.NoError(t, err)
+			defer client.Close()
+
+			gcs := &GoogleCloudStorage{ctx: ctx, client: client, config: &GoogleConfig{Bucket: "test-bucket", ResumableUploadThreshold: tt.threshold, UploadChunkSize: tt.chunkSize}}
+			w := gcs.newWriter("file", tt.fileSize)
+			require.Equal(t, tt.expectedChunkSize, w.ChunkSize)
+		})
+	}
+}
+
+func TestIsRetryableUploadErr(t *testing.T) {
+	require.True(t, isRetryableUploadErr(fmt.Errorf("Error closing file writer: %w", &googleapi.Error{Code: http.StatusServiceUnavailable})))
+	require.True(t, isRetryableUploadErr(&googleapi.Error{Code: http.StatusTooManyRequests}))
+	require.True(t, isRetryableUploadErr(fmt.Errorf("Error writing file: %w", io.ErrUnexpectedEOF)))
+	require.False(t, isRetryableUploadErr(&googleapi.Error{Code: http.StatusForbidden}))
+	require.False(t, isRetryableUploadErr(errors.New("some error")))
+}
+
+func TestEnsureBucket(t *testing.T) {
+	tests := []struct {
+		name            string
+		bucketStatus    int
+		expectedMethods []string
+	}{
+		{"create if missing", http.StatusNotFound, []string{http.MethodGet, http.MethodPost}},
+		{"existing bucket", http.StatusOK, []string{http.MethodGet}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var methods []string
+			httpClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				methods = append(methods, req.Method)
+				statusCode, body := http.StatusOK, `{"name":"test-bucket"}`
+				if req.Method == http.MethodGet {
+					statusCode = tt.bucketStatus
+					if statusCode == http.StatusNotFound {
+						body = `{"error":{"code":404,"message":"Not Found"}}`
+					}
+				}
+				return &http.Response{
+					StatusCode: statusCode,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+					Request:    req,
+				}, nil
+			})}
+
+			config := &GoogleConfig{Bucket: "test-bucket", Project: "test-project", CreateBucket: true, BucketLocation: "EU", BucketLifecycleDeleteAgeDays: 7}
+			gcs, err := NewGoogleCloudStorage(context.Background(), config, option.WithHTTPClient(httpClient))
+			require.NoError(t, err)
+			defer gcs.Close()
+
+			require.NoError(t, gcs.ensureBucket())
+			require.NoError(t, gcs.ensureBucket())
+			require.Equal(t, tt.expectedMethods, methods, "Bucket must be checked (and created) only once")
+		})
+	}
+
+	gcs := &GoogleCloudStorage{config: &GoogleConfig{Bucket: "test-bucket"}}
+	require.NoError(t, gcs.ensureBucket(), "Bucket mustn't be checked without gcs_create_bucket")
+}
@@ -0,0 +1,28 @@
+package adapters
+
+import "sync"
+
+//Set of mutexes per key: operations with the same key are serialized
+//while operations with different keys run in parallel
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*sync.Mutex{}}
+}
+
+//Lock key mutex and return unlock function
+func (km *keyedMutex) Lock(key string) func() {
+	km.mutex.Lock()
+	lock, ok := km.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		km.locks[key] = lock
+	}
+	km.mutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
@@ -0,0 +1,38 @@
+package adapters
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	km := newKeyedMutex()
+
+	//max count of goroutines holding the same key simultaneously
+	run := func(keys []string) int32 {
+		var current, max int32
+		wg := sync.WaitGroup{}
+		for _, key := range keys {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				unlock := km.Lock(key)
+				defer unlock()
+
+				if c := atomic.AddInt32(&current, 1); c > atomic.LoadInt32(&max) {
+					atomic.StoreInt32(&max, c)
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&current, -1)
+			}(key)
+		}
+		wg.Wait()
+		return max
+	}
+
+	require.Equal(t, int32(1), run([]string{"events", "events", "events", "events", "events"}), "Same key operations must be serialized")
+	require.True(t, run([]string{"events1", "events2", "events3", "events4", "events5"}) > 1, "Different keys operations must run in parallel")
+}
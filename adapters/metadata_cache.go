@@ -0,0 +1,64 @@
+package adapters
+
+import (
+	"cloud.google.com/go/bigquery"
+	"sync"
+	"time"
+)
+
+//Concurrency-safe in-memory cache of google BigQuery tables metadata
+//Entries expire after ttl. Cache is disabled if ttl isn't positive or cache is nil
+type metadataCache struct {
+	mutex   sync.RWMutex
+	ttl     time.Duration
+	entries map[string]*metadataCacheEntry
+	clock   Clock
+}
+
+type metadataCacheEntry struct {
+	metadata  *bigquery.TableMetadata
+	expiresAt time.Time
+}
+
+func newMetadataCache(ttl time.Duration) *metadataCache {
+	return &metadataCache{ttl: ttl, entries: map[string]*metadataCacheEntry{}, clock: realClock{}}
+}
+
+//Return cached table metadata and true if it exists and isn't expired
+func (mc *metadataCache) Get(key string) (*bigquery.TableMetadata, bool) {
+	if mc == nil || mc.ttl <= 0 {
+		return nil, false
+	}
+
+	mc.mutex.RLock()
+	entry, ok := mc.entries[key]
+	mc.mutex.RUnlock()
+
+	if !ok || mc.clock.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	return entry.metadata, true
+}
+
+//Put table metadata into the cache
+func (mc *metadataCache) Put(key string, metadata *bigquery.TableMetadata) {
+	if mc == nil || mc.ttl <= 0 || metadata == nil {
+		return
+	}
+
+	mc.mutex.Lock()
+	mc.entries[key] = &metadataCacheEntry{metadata: metadata, expiresAt: mc.clock.Now().Add(mc.ttl)}
+	mc.mutex.Unlock()
+}
+
+//Remove table metadata from the cache
+func (mc *metadataCache) Invalidate(key string) {
+	if mc == nil {
+		return
+	}
+
+	mc.mutex.Lock()
+	delete(mc.entries, key)
+	mc.mutex.Unlock()
+}
@@ -0,0 +1,62 @@
+package adapters
+
+import (
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetadataCache(t *testing.T) {
+	metadata := &bigquery.TableMetadata{Name: "events"}
+
+	clock := newFakeClock()
+	cache := newMetadataCache(time.Minute)
+	cache.clock = clock
+	_, ok := cache.Get("dataset.events")
+	require.False(t, ok)
+
+	cache.Put("dataset.events", metadata)
+	cached, ok := cache.Get("dataset.events")
+	require.True(t, ok)
+	require.Equal(t, metadata, cached)
+
+	cache.Invalidate("dataset.events")
+	_, ok = cache.Get("dataset.events")
+	require.False(t, ok, "Invalidated entry mustn't be returned")
+
+	cache.Put("dataset.events", metadata)
+	clock.Advance(time.Minute)
+	_, ok = cache.Get("dataset.events")
+	require.True(t, ok, "Entry must be returned until TTL end")
+	clock.Advance(time.Nanosecond)
+	_, ok = cache.Get("dataset.events")
+	require.False(t, ok, "Expired entry mustn't be returned")
+
+	disabled := newMetadataCache(0)
+	disabled.Put("dataset.events", metadata)
+	_, ok = disabled.Get("dataset.events")
+	require.False(t, ok, "Cache must be disabled without TTL")
+}
+
+func TestMetadataCacheConcurrency(t *testing.T) {
+	cache := newMetadataCache(time.Minute)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "dataset.events" + strconv.Itoa(i%3)
+			for j := 0; j < 100; j++ {
+				cache.Put(key, &bigquery.TableMetadata{Name: key})
+				if metadata, ok := cache.Get(key); ok {
+					require.Equal(t, key, metadata.Name)
+				}
+				cache.Invalidate(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,51 @@
+package adapters
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"sync"
+)
+
+//Staging file: object key and payload
+type StagingFile struct {
+	Key     string
+	Payload []byte
+}
+
+//Upload files with upload func using not more than concurrency parallel uploads (sequentially if concurrency <= 1)
+//Return keys of uploaded files in the same order as files and all upload errors aggregated into one
+func uploadFiles(files []*StagingFile, concurrency int, upload func(key string, payload []byte) error) ([]string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	errs := make([]error, len(files))
+	semaphore := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, file := range files {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, file *StagingFile) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if err := upload(file.Key, file.Payload); err != nil {
+				errs[i] = fmt.Errorf("Error uploading file %s: %v", file.Key, err)
+			}
+		}(i, file)
+	}
+	wg.Wait()
+
+	var keys []string
+	var multiErr error
+	for i, file := range files {
+		if errs[i] != nil {
+			multiErr = multierror.Append(multiErr, errs[i])
+			continue
+		}
+		keys = append(keys, file.Key)
+	}
+
+	return keys, multiErr
+}
@@ -0,0 +1,72 @@
+package adapters
+
+import (
+	"errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ksensehq/eventnative/test"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadFiles(t *testing.T) {
+	var files []*StagingFile
+	for _, key := range []string{"file1", "file2", "file3", "file4", "file5", "file6"} {
+		files = append(files, &StagingFile{Key: key, Payload: []byte(key)})
+	}
+
+	tests := []struct {
+		name             string
+		concurrency      int
+		failedKeys       map[string]bool
+		expectedKeys     []string
+		expectedErrs     int
+		expectedParallel int
+	}{
+		{"sequential", 0, nil, []string{"file1", "file2", "file3", "file4", "file5", "file6"}, 0, 1},
+		{"parallel", 3, nil, []string{"file1", "file2", "file3", "file4", "file5", "file6"}, 0, 3},
+		{"errors", 3, map[string]bool{"file2": true, "file5": true}, []string{"file1", "file3", "file4", "file6"}, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex := sync.Mutex{}
+			current, max := 0, 0
+			uploaded := map[string]string{}
+			keys, err := uploadFiles(files, tt.concurrency, func(key string, payload []byte) error {
+				mutex.Lock()
+				current++
+				if current > max {
+					max = current
+				}
+				mutex.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				current--
+				if tt.failedKeys[key] {
+					return errors.New("upload error")
+				}
+				uploaded[key] = string(payload)
+				return nil
+			})
+
+			test.ObjectsEqual(t, tt.expectedKeys, keys, "Uploaded keys aren't equal")
+			require.Equal(t, tt.expectedParallel, max, "Wrong max count of parallel uploads")
+			require.Equal(t, len(tt.expectedKeys), len(uploaded))
+			for _, key := range tt.expectedKeys {
+				require.Equal(t, key, uploaded[key])
+			}
+
+			if tt.expectedErrs == 0 {
+				require.NoError(t, err)
+				return
+			}
+			multiErr, ok := err.(*multierror.Error)
+			require.True(t, ok, "Errors must be aggregated")
+			require.Equal(t, tt.expectedErrs, len(multiErr.Errors))
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package adapters
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const defaultRetryDelay = time.Second
+
+//Run f and rerun it up to retries times while it returns retryable errors (according to isRetryable)
+//Delay before n-th retry is baseDelay * 2^(n-1) with random jitter (from half to full delay)
+//Delays are measured with clock
+//Return last f error or ctx error if ctx is done while waiting
+func retry(ctx context.Context, clock Clock, retries int, baseDelay time.Duration, isRetryable func(error) bool, f func() error) error {
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryDelay
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= retries || !isRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(backoffDelay(baseDelay, attempt)):
+		}
+	}
+}
+
+//Return exponential delay with jitter: random value in [delay/2, delay] where delay = baseDelay * 2^attempt
+func backoffDelay(baseDelay time.Duration, attempt int) time.Duration {
+	delay := baseDelay << uint(attempt)
+	if delay <= 0 {
+		//overflow
+		delay = baseDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
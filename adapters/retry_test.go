@@ -0,0 +1,100 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient error")
+	errFatal     = errors.New("fatal error")
+)
+
+func isTransient(err error) bool {
+	return err == errTransient
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		retries       int
+		errs          []error
+		expectedErr   error
+		expectedCalls int
+	}{
+		{
+			"Success without retries",
+			3,
+			[]error{nil},
+			nil,
+			1,
+		},
+		{
+			"Fail twice then succeed",
+			3,
+			[]error{errTransient, errTransient, nil},
+			nil,
+			3,
+		},
+		{
+			"Retries are exhausted",
+			2,
+			[]error{errTransient, errTransient, errTransient, nil},
+			errTransient,
+			3,
+		},
+		{
+			"Not retryable error fails fast",
+			3,
+			[]error{errFatal, nil},
+			errFatal,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			start := clock.Now()
+			calls := 0
+			err := retry(context.Background(), clock, tt.retries, time.Second, isTransient, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			require.Equal(t, tt.expectedErr, err)
+			require.Equal(t, tt.expectedCalls, calls)
+
+			//exponential backoff: delays sum is in [sum/2, sum] where sum = 1s + 2s + ...
+			var maxWait time.Duration
+			for attempt := 0; attempt < calls-1; attempt++ {
+				maxWait += time.Second << uint(attempt)
+			}
+			waited := clock.Now().Sub(start)
+			require.True(t, waited >= maxWait/2 && waited <= maxWait, "Waited %s isn't in [%s, %s]", waited, maxWait/2, maxWait)
+		})
+	}
+}
+
+func TestRetryContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := retry(ctx, realClock{}, 5, time.Minute, isTransient, func() error {
+		calls++
+		return errTransient
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 5; attempt++ {
+		delay := backoffDelay(time.Second, attempt)
+		max := time.Second << uint(attempt)
+		require.True(t, delay >= max/2 && delay <= max, "Delay %s isn't in [%s, %s]", delay, max/2, max)
+	}
+}
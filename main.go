@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"github.com/gin-gonic/gin"
+	"github.com/ksensehq/eventnative/adapters"
 	"github.com/ksensehq/eventnative/appconfig"
 	"github.com/ksensehq/eventnative/appstatus"
 	"github.com/ksensehq/eventnative/events"
@@ -96,7 +97,7 @@ func main() {
 	}
 
 	//Create event storages per token
-	tokenizedEventStorages := storages.CreateStorages(ctx, destinationsViper)
+	tokenizedEventStorages := storages.CreateStorages(ctx, destinationsViper, adapters.NewRealClock())
 	for _, eStorages := range tokenizedEventStorages {
 		for _, es := range eStorages {
 			appconfig.Instance.ScheduleClosing(es)
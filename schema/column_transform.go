@@ -0,0 +1,69 @@
+package schema
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+//Column name -> function for changing column value before writing to the staging file
+//e.g. lowercase emails, hash PII, parse timestamps
+type ColumnTransform map[string]func(interface{}) (interface{}, error)
+
+//Built-in transformation functions which can be configured by name (data_layout.column_transforms)
+var columnTransformFunctions = map[string]func(interface{}) (interface{}, error){
+	"lowercase": stringTransform(strings.ToLower),
+	"uppercase": stringTransform(strings.ToUpper),
+	"trim":      stringTransform(strings.TrimSpace),
+	"sha256": stringTransform(func(value string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))
+	}),
+}
+
+//Return ColumnTransform from column name -> built-in transformation function name mapping
+//Return error if function name is unknown
+func NewColumnTransform(functionNames map[string]string) (ColumnTransform, error) {
+	if len(functionNames) == 0 {
+		return nil, nil
+	}
+
+	ct := ColumnTransform{}
+	for columnName, functionName := range functionNames {
+		transform, ok := columnTransformFunctions[strings.ToLower(functionName)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown column %s transformation function: %s. Supported: lowercase, uppercase, trim, sha256", columnName, functionName)
+		}
+		ct[formatKey(columnName)] = transform
+	}
+
+	return ct, nil
+}
+
+//Apply transformation functions to object fields in place
+//Return error if at least one transformation fails (object should be skipped)
+func (ct ColumnTransform) Apply(object map[string]interface{}) error {
+	for columnName, transform := range ct {
+		value, ok := object[columnName]
+		if !ok {
+			continue
+		}
+
+		transformed, err := transform(value)
+		if err != nil {
+			return fmt.Errorf("Error transforming column %s value: %v", columnName, err)
+		}
+		object[columnName] = transformed
+	}
+
+	return nil
+}
+
+//Return transformation function of string values. Other values are converted to strings first
+func stringTransform(f func(string) string) func(interface{}) (interface{}, error) {
+	return func(value interface{}) (interface{}, error) {
+		if s, ok := value.(string); ok {
+			return f(s), nil
+		}
+		return f(fmt.Sprint(value)), nil
+	}
+}
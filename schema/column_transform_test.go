@@ -0,0 +1,22 @@
+package schema
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/ksensehq/eventnative/test"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewColumnTransform(t *testing.T) {
+	ct, err := NewColumnTransform(map[string]string{"/user/email": "SHA256", "name": "lowercase", "city": "trim"})
+	require.NoError(t, err)
+
+	object := map[string]interface{}{"user_email": "a@b.com", "name": "John", "city": " Berlin ", "age": "33"}
+	require.NoError(t, ct.Apply(object))
+	expected := map[string]interface{}{"user_email": fmt.Sprintf("%x", sha256.Sum256([]byte("a@b.com"))), "name": "john", "city": "Berlin", "age": "33"}
+	test.ObjectsEqual(t, expected, object, "Wrong transformed object")
+
+	_, err = NewColumnTransform(map[string]string{"email": "unknown"})
+	require.Error(t, err, "Unknown transformation function must return error")
+}
@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Return unified-diff-like text representation of changes between live and desired schemas:
+// + column TYPE            - column exists only in desired schema
+// - column TYPE            - column exists only in live schema
+// ~ column TYPE -> TYPE    - column type is changed
+//Columns are sorted by name. Return empty string if there are no changes
+func RenderDiff(live, desired *Table) string {
+	liveColumns, desiredColumns := Columns{}, Columns{}
+	liveName, desiredName := "", ""
+	if live != nil {
+		liveName = live.Name
+		liveColumns = live.Columns
+	}
+	if desired != nil {
+		desiredName = desired.Name
+		desiredColumns = desired.Columns
+	}
+
+	names := map[string]bool{}
+	for name := range liveColumns {
+		names[name] = true
+	}
+	for name := range desiredColumns {
+		names[name] = true
+	}
+	var sortedNames []string
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	var lines []string
+	for _, name := range sortedNames {
+		liveColumn, inLive := liveColumns[name]
+		desiredColumn, inDesired := desiredColumns[name]
+		switch {
+		case !inLive:
+			lines = append(lines, fmt.Sprintf("+ %s %s", name, desiredColumn.Type))
+		case !inDesired:
+			lines = append(lines, fmt.Sprintf("- %s %s", name, liveColumn.Type))
+		case liveColumn.Type != desiredColumn.Type:
+			lines = append(lines, fmt.Sprintf("~ %s %s -> %s", name, liveColumn.Type, desiredColumn.Type))
+		}
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	header := []string{"--- " + liveName, "+++ " + desiredName}
+	return strings.Join(append(header, lines...), "\n")
+}
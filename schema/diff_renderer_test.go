@@ -0,0 +1,45 @@
+package schema
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRenderDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		live     *Table
+		desired  *Table
+		expected string
+	}{
+		{
+			"Equal schemas",
+			&Table{Name: "events", Columns: Columns{"col1": Column{Type: STRING}}},
+			&Table{Name: "events", Columns: Columns{"col1": Column{Type: STRING}}},
+			"",
+		},
+		{
+			"Not existing live schema",
+			nil,
+			&Table{Name: "events", Columns: Columns{"col2": Column{Type: STRING}, "col1": Column{Type: STRING}}},
+			"--- \n+++ events\n+ col1 STRING\n+ col2 STRING",
+		},
+		{
+			"Added and removed columns",
+			&Table{Name: "events", Columns: Columns{"col1": Column{Type: STRING}, "col3": Column{Type: STRING}}},
+			&Table{Name: "events", Columns: Columns{"col1": Column{Type: STRING}, "col2": Column{Type: STRING}}},
+			"--- events\n+++ events\n+ col2 STRING\n- col3 STRING",
+		},
+		{
+			"Changed column type",
+			&Table{Name: "events", Columns: Columns{"col1": Column{Type: STRING}, "col2": Column{Type: INTEGER}}},
+			&Table{Name: "events", Columns: Columns{"col1": Column{Type: TIMESTAMP}, "col2": Column{Type: INTEGER}}},
+			"--- events\n+++ events\n~ col1 STRING -> TIMESTAMP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, RenderDiff(tt.live, tt.desired))
+		})
+	}
+}
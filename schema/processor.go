@@ -9,13 +9,44 @@ import (
 	"io"
 	"log"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
+const (
+	//write source field into column with numeric suffix if its flattened key is taken by another source field: a_b, a_b_1, a_b_2
+	SuffixCollisionStrategy = "suffix"
+	//return error if flattened key is taken by another source field
+	ErrorCollisionStrategy = "error"
+
+	//max count of remembered logged collisions (table and source field path)
+	maxLoggedCollisions = 10000
+)
+
 type Processor struct {
 	fieldMapper          Mapper
 	tableNameExtractFunc TableNameExtractFunction
+	columnTransform      ColumnTransform
+	collisionStrategy    string
+	deadLetter           func(object []byte, err error)
+
+	//table name:source field path of already logged collisions
+	loggedCollisionsMutex sync.Mutex
+	loggedCollisions      map[string]bool
+}
+
+//Optional processor settings
+type ProcessorOptions struct {
+	//column name -> function applied to flattened and mapped value (nil - values are written as is)
+	ColumnTransform ColumnTransform
+	//flattened keys collision strategy: suffix (default) or error
+	CollisionStrategy string
+	//destination of objects skipped because of processing errors (e.g. failed column transformation)
+	//with the reason (nil - skipped objects are only logged)
+	DeadLetter func(object []byte, err error)
 }
 
 type ProcessedFile struct {
@@ -24,12 +55,21 @@ type ProcessedFile struct {
 	DataSchema *Table
 }
 
-func NewProcessor(tableNameFuncExpression string, mappings []string) (*Processor, error) {
+func NewProcessor(tableNameFuncExpression string, mappings []string, options ProcessorOptions) (*Processor, error) {
 	mapper, err := NewFieldMapper(mappings)
 	if err != nil {
 		return nil, err
 	}
 
+	collisionStrategy := options.CollisionStrategy
+	switch collisionStrategy {
+	case "":
+		collisionStrategy = SuffixCollisionStrategy
+	case SuffixCollisionStrategy, ErrorCollisionStrategy:
+	default:
+		return nil, fmt.Errorf("Unknown flatten collision strategy: %s. Supported: %s, %s", collisionStrategy, SuffixCollisionStrategy, ErrorCollisionStrategy)
+	}
+
 	tmpl, err := template.New("table name extract").
 		Option("missingkey=error").
 		Parse(tableNameFuncExpression)
@@ -57,7 +97,19 @@ func NewProcessor(tableNameFuncExpression string, mappings []string) (*Processor
 		return buf.String(), nil
 	}
 
-	return &Processor{fieldMapper: mapper, tableNameExtractFunc: tableNameExtractFunc}, nil
+	return &Processor{
+		fieldMapper:          mapper,
+		tableNameExtractFunc: tableNameExtractFunc,
+		columnTransform:      options.ColumnTransform,
+		collisionStrategy:    collisionStrategy,
+		deadLetter:           options.DeadLetter,
+		loggedCollisions:     map[string]bool{},
+	}, nil
+}
+
+//Return configured column transformation functions (nil if they aren't configured)
+func (p *Processor) ColumnTransform() ColumnTransform {
+	return p.columnTransform
 }
 
 //Process file payload lines divided with \n. Line by line where 1 line = 1 json
@@ -76,6 +128,9 @@ func (p *Processor) Process(fileName string, payload []byte, breakOnError bool)
 				return nil, err
 			} else {
 				log.Printf("Warn: unable to process object %s reason: %v. This line will be skipped", string(line), err)
+				if p.deadLetter != nil {
+					p.deadLetter(bytes.TrimSpace(line), err)
+				}
 			}
 		}
 
@@ -101,7 +156,7 @@ func (p *Processor) Process(fileName string, payload []byte, breakOnError bool)
 	return filePerTable, nil
 }
 
-//Flatten all json keys from /key1/key2 to key1_key2 and apply mappings
+//Flatten all json keys from /key1/key2 to key1_key2, apply mappings and column transformations
 //Return table representation of object and object json bytes
 func (p *Processor) processObject(line []byte) (*Table, []byte, error) {
 	object := map[string]interface{}{}
@@ -111,7 +166,7 @@ func (p *Processor) processObject(line []byte) (*Table, []byte, error) {
 		return nil, nil, err
 	}
 
-	flatObject, err := p.flattenObject(object)
+	flatObject, collisions, err := p.flattenObject(object)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -123,9 +178,14 @@ func (p *Processor) processObject(line []byte) (*Table, []byte, error) {
 	if tableName == "" {
 		return nil, nil, fmt.Errorf("Unknown table name. Object {%v}", flatObject)
 	}
+	p.logCollisions(tableName, collisions)
 
 	mappedObject := p.fieldMapper.Map(flatObject)
 
+	if err := p.columnTransform.Apply(mappedObject); err != nil {
+		return nil, nil, err
+	}
+
 	objectBytes, err := json.Marshal(mappedObject)
 	if err != nil {
 		return nil, nil, err
@@ -140,20 +200,19 @@ func (p *Processor) processObject(line []byte) (*Table, []byte, error) {
 }
 
 //Return flatten object e.g. from {"key1":{"key2":123}} to {"key1_key2":123}
-func (p *Processor) flattenObject(json map[string]interface{}) (map[string]interface{}, error) {
-	flattenMap := make(map[string]interface{})
-
-	err := p.flatten("", json, flattenMap)
-	if err != nil {
-		return nil, err
+//and source field path (e.g. /a/b) -> column name of fields written into columns with numeric suffix (see resolveCollisions)
+func (p *Processor) flattenObject(json map[string]interface{}) (map[string]interface{}, map[string]string, error) {
+	fields := map[string][]*flattenedField{}
+	if err := p.flatten("", nil, json, fields); err != nil {
+		return nil, nil, err
 	}
 
-	return flattenMap, nil
-
+	return p.resolveCollisions(fields)
 }
 
 //omit nil values
-func (p *Processor) flatten(key string, value interface{}, destination map[string]interface{}) error {
+//path is source field path: keys of all nesting levels
+func (p *Processor) flatten(key string, path []string, value interface{}, destination map[string][]*flattenedField) error {
 	t := reflect.ValueOf(value)
 	switch t.Kind() {
 	case reflect.Slice:
@@ -161,7 +220,7 @@ func (p *Processor) flatten(key string, value interface{}, destination map[strin
 		if err != nil {
 			return fmt.Errorf("Error marshaling array with key %s: %v", key, err)
 		}
-		destination[key] = string(b)
+		destination[key] = append(destination[key], &flattenedField{path: path, value: string(b)})
 	case reflect.Map:
 		unboxed := value.(map[string]interface{})
 		for k, v := range unboxed {
@@ -169,15 +228,106 @@ func (p *Processor) flatten(key string, value interface{}, destination map[strin
 			if key != "" {
 				newKey = key + "_" + newKey
 			}
-			if err := p.flatten(newKey, v, destination); err != nil {
+			if err := p.flatten(newKey, append(append([]string{}, path...), k), v, destination); err != nil {
 				return fmt.Errorf("Error flatten object with key %s_%s: %v", key, k, err)
 			}
 		}
 	default:
 		if value != nil {
-			destination[key] = fmt.Sprintf("%v", value)
+			destination[key] = append(destination[key], &flattenedField{path: path, value: fmt.Sprintf("%v", value)})
 		}
 	}
 
 	return nil
 }
+
+//Return flattened object from flattened key -> fields with this key
+//Collisions (several source fields with the same flattened key e.g. {"a":{"b":1}} and {"a_b":2}) are resolved
+//within the object only and don't depend on other objects: the field with the least nesting depth (and then the first
+//path in alphabetical order) keeps the flattened key, others are written into the first free keys with numeric suffix
+//(a_b_1, a_b_2) or error is returned (according to collision strategy)
+func (p *Processor) resolveCollisions(fields map[string][]*flattenedField) (map[string]interface{}, map[string]string, error) {
+	flattenMap := make(map[string]interface{}, len(fields))
+	var collidedKeys []string
+	for key, keyFields := range fields {
+		if len(keyFields) == 1 {
+			flattenMap[key] = keyFields[0].value
+		} else {
+			collidedKeys = append(collidedKeys, key)
+		}
+	}
+	if len(collidedKeys) == 0 {
+		return flattenMap, nil, nil
+	}
+
+	sort.Strings(collidedKeys)
+	collisions := map[string]string{}
+	for _, key := range collidedKeys {
+		keyFields := fields[key]
+		sort.Slice(keyFields, func(i, j int) bool {
+			if len(keyFields[i].path) != len(keyFields[j].path) {
+				return len(keyFields[i].path) < len(keyFields[j].path)
+			}
+			return keyFields[i].sourcePath() < keyFields[j].sourcePath()
+		})
+
+		if p.collisionStrategy == ErrorCollisionStrategy {
+			return nil, nil, fmt.Errorf("Flattened key %s of %s field collides with %s field", key, keyFields[1].sourcePath(), keyFields[0].sourcePath())
+		}
+
+		flattenMap[key] = keyFields[0].value
+		suffix := 1
+		for _, field := range keyFields[1:] {
+			column := fmt.Sprintf("%s_%d", key, suffix)
+			for p.isTaken(column, fields, flattenMap) {
+				suffix++
+				column = fmt.Sprintf("%s_%d", key, suffix)
+			}
+			suffix++
+
+			flattenMap[column] = field.value
+			collisions[field.sourcePath()] = column
+		}
+	}
+
+	return flattenMap, collisions, nil
+}
+
+//Return true if column is flattened key of another source field or is already assigned
+func (p *Processor) isTaken(column string, fields map[string][]*flattenedField, flattenMap map[string]interface{}) bool {
+	if _, ok := fields[column]; ok {
+		return true
+	}
+	_, ok := flattenMap[column]
+	return ok
+}
+
+//Log collisions of table once per source field path (while there are less than maxLoggedCollisions logged ones)
+func (p *Processor) logCollisions(tableName string, collisions map[string]string) {
+	p.loggedCollisionsMutex.Lock()
+	defer p.loggedCollisionsMutex.Unlock()
+
+	for path, column := range collisions {
+		key := tableName + ":" + path
+		if p.loggedCollisions[key] {
+			continue
+		}
+		//keys can be dynamic: logged collisions are forgotten (and will be logged again) instead of unbounded growth
+		if len(p.loggedCollisions) >= maxLoggedCollisions {
+			p.loggedCollisions = map[string]bool{}
+		}
+		p.loggedCollisions[key] = true
+		log.Printf("Warn: flattened key of %s field collides with another field in table %s. %s field values will be written into %s column", path, tableName, path, column)
+	}
+}
+
+//Flattened value with its source field path
+type flattenedField struct {
+	path  []string
+	value string
+}
+
+//Return source field path e.g. /a/b
+func (ff *flattenedField) sourcePath() string {
+	return "/" + strings.Join(ff.path, "/")
+}
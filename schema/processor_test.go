@@ -2,9 +2,14 @@ package schema
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"github.com/ksensehq/eventnative/test"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
+	"log"
+	"os"
 	"strings"
 	"testing"
 )
@@ -45,11 +50,11 @@ func TestFlattenObject(t *testing.T) {
 				"key8_sub_key2": "123123.3123", "key8_sub_key3_sub_sub_key1": "[\"1,\",\"2.\"]"},
 		},
 	}
-	p, err := NewProcessor("", []string{})
+	p, err := NewProcessor("", []string{}, ProcessorOptions{})
 	require.NoError(t, err)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			actualFlattenJson, err := p.flattenObject(tt.inputJson)
+			actualFlattenJson, _, err := p.flattenObject(tt.inputJson)
 			require.NoError(t, err)
 			test.ObjectsEqual(t, tt.expectedJson, actualFlattenJson, "Wrong flattened json")
 		})
@@ -105,7 +110,7 @@ func TestProcess(t *testing.T) {
 			},
 		},
 	}
-	p, err := NewProcessor(`{{.event_type}}_{{._timestamp.Format "2006_01"}}`, []string{})
+	p, err := NewProcessor(`{{.event_type}}_{{._timestamp.Format "2006_01"}}`, []string{}, ProcessorOptions{})
 	require.NoError(t, err)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -140,3 +145,104 @@ func TestProcess(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessColumnTransform(t *testing.T) {
+	hashTransform := func(v interface{}) (interface{}, error) {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(v.(string)))), nil
+	}
+	errorTransform := func(v interface{}) (interface{}, error) {
+		if v == "bad" {
+			return nil, errors.New("bad value")
+		}
+		return v, nil
+	}
+	payload := []byte(`{"_timestamp":"2020-08-02T18:23:58.057807Z","email":"a@b.com","status":"ok"}
+{"_timestamp":"2020-08-02T18:23:59.057807Z","email":"c@d.com","status":"bad"}
+`)
+
+	var deadLetters []string
+	deadLetter := func(object []byte, err error) {
+		deadLetters = append(deadLetters, string(object))
+		require.Error(t, err)
+	}
+	p, err := NewProcessor("events", []string{}, ProcessorOptions{ColumnTransform: ColumnTransform{"email": hashTransform, "status": errorTransform}, DeadLetter: deadLetter})
+	require.NoError(t, err)
+
+	actualResult, err := p.Process("testfile", payload, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(actualResult), "Result sizes aren't equal")
+
+	lines := strings.Split(actualResult["events"].Payload.String(), "\n")
+	require.Equal(t, 1, len(lines), "Line with erroring transform must be skipped")
+	expected := fmt.Sprintf(`{"_timestamp":"2020-08-02T18:23:58.057807Z","email":"%x","status":"ok"}`, sha256.Sum256([]byte("a@b.com")))
+	test.JsonBytesEqual(t, []byte(expected), []byte(lines[0]), "Transformed lines aren't equal")
+	test.ObjectsEqual(t, []string{`{"_timestamp":"2020-08-02T18:23:59.057807Z","email":"c@d.com","status":"bad"}`}, deadLetters, "Line with erroring transform must be sent to dead-letter")
+
+	_, err = p.Process("testfile", payload, true)
+	require.Error(t, err, "Erroring transform must break processing")
+}
+
+func TestFlattenObjectCollision(t *testing.T) {
+	inputJson := map[string]interface{}{
+		"a":   map[string]interface{}{"b": 1, "b_1": 3},
+		"a_b": 2,
+		"c":   "value",
+	}
+
+	p, err := NewProcessor("", []string{}, ProcessorOptions{CollisionStrategy: SuffixCollisionStrategy})
+	require.NoError(t, err)
+	actualFlattenJson, collisions, err := p.flattenObject(inputJson)
+	require.NoError(t, err)
+	//nested a.b takes the suffix (a_b_1 is taken by a.b_1)
+	test.ObjectsEqual(t, map[string]interface{}{"a_b": "2", "a_b_1": "3", "a_b_2": "1", "c": "value"}, actualFlattenJson, "Wrong flattened json")
+	test.ObjectsEqual(t, map[string]string{"/a/b": "a_b_2"}, collisions, "Wrong collisions")
+
+	//resolution doesn't depend on previous objects
+	for i := 0; i < 2; i++ {
+		actualFlattenJson, collisions, err = p.flattenObject(map[string]interface{}{"a": map[string]interface{}{"b": 4}})
+		require.NoError(t, err)
+		test.ObjectsEqual(t, map[string]interface{}{"a_b": "4"}, actualFlattenJson, "Nested a.b without collision must be written into a_b")
+		require.Empty(t, collisions)
+
+		actualFlattenJson, _, err = p.flattenObject(map[string]interface{}{"a": map[string]interface{}{"b": 1}, "a_b": 2})
+		require.NoError(t, err)
+		test.ObjectsEqual(t, map[string]interface{}{"a_b": "2", "a_b_1": "1"}, actualFlattenJson, "Nested a.b must take the suffix")
+	}
+
+	//several nested fields with the same key are ordered by path
+	actualFlattenJson, _, err = p.flattenObject(map[string]interface{}{
+		"a_b": map[string]interface{}{"c": 2},
+		"a":   map[string]interface{}{"b_c": 1},
+	})
+	require.NoError(t, err)
+	test.ObjectsEqual(t, map[string]interface{}{"a_b_c": "1", "a_b_c_1": "2"}, actualFlattenJson, "Wrong flattened json")
+
+	p, err = NewProcessor("", []string{}, ProcessorOptions{CollisionStrategy: ErrorCollisionStrategy})
+	require.NoError(t, err)
+	_, _, err = p.flattenObject(inputJson)
+	require.Error(t, err, "Flatten collision must return error")
+
+	//objects without collision aren't affected by previous objects
+	_, _, err = p.flattenObject(map[string]interface{}{"a_b": 2})
+	require.NoError(t, err)
+	_, _, err = p.flattenObject(map[string]interface{}{"a": map[string]interface{}{"b": 1}})
+	require.NoError(t, err, "Objects without collision mustn't be rejected")
+
+	_, err = NewProcessor("", []string{}, ProcessorOptions{CollisionStrategy: "unknown"})
+	require.Error(t, err, "Unknown collision strategy must return error")
+}
+
+func TestLogCollisionsBounded(t *testing.T) {
+	p, err := NewProcessor("", []string{}, ProcessorOptions{})
+	require.NoError(t, err)
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for i := 0; i < maxLoggedCollisions+10; i++ {
+		p.logCollisions("events", map[string]string{fmt.Sprintf("/a%d/b", i): fmt.Sprintf("a%d_b_1", i)})
+	}
+	require.True(t, len(p.loggedCollisions) <= maxLoggedCollisions, "Logged collisions must be bounded")
+
+	p.logCollisions("events_2020_08", map[string]string{"/a0/b": "a0_b_1"})
+	require.True(t, p.loggedCollisions["events_2020_08:/a0/b"], "Logged collisions must be scoped per table")
+}
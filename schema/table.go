@@ -4,6 +4,11 @@ type DataType int
 
 const (
 	STRING DataType = iota
+	INTEGER
+	FLOAT
+	BOOLEAN
+	//value format: timestamp.Layout (RFC3339 in UTC with microseconds) e.g. 2020-08-02T18:23:56.291383Z
+	TIMESTAMP
 )
 
 func (dt DataType) String() string {
@@ -12,6 +17,14 @@ func (dt DataType) String() string {
 		return ""
 	case STRING:
 		return "STRING"
+	case INTEGER:
+		return "INTEGER"
+	case FLOAT:
+		return "FLOAT"
+	case BOOLEAN:
+		return "BOOLEAN"
+	case TIMESTAMP:
+		return "TIMESTAMP"
 	}
 }
 
@@ -29,6 +42,21 @@ func (c Columns) Merge(other Columns) {
 type Table struct {
 	Name    string
 	Columns Columns
+	//nil - table isn't partitioned
+	Partitioning *TimePartitioning
+	//ordered clustering column names (empty - table isn't clustered)
+	ClusteringFields []string
+	Labels           map[string]string
+}
+
+//DAY is the only supported partition type
+const DayPartitionType = "DAY"
+
+type TimePartitioning struct {
+	//TIMESTAMP column name (empty - partitioning by load time)
+	Field string
+	//partition type (DayPartitionType if empty)
+	Type string
 }
 
 //Return true if there is at least one column
@@ -61,4 +89,27 @@ func (t Table) Diff(another *Table) *Table {
 
 type Column struct {
 	Type DataType
+	Mode Mode
+}
+
+//Column mode (NULLABLE by default)
+type Mode int
+
+const (
+	NULLABLE Mode = iota
+	REQUIRED
+	REPEATED
+)
+
+func (m Mode) String() string {
+	switch m {
+	default:
+		return ""
+	case NULLABLE:
+		return "NULLABLE"
+	case REQUIRED:
+		return "REQUIRED"
+	case REPEATED:
+		return "REPEATED"
+	}
 }
@@ -0,0 +1,130 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	dataTypes = map[string]DataType{
+		STRING.String():    STRING,
+		INTEGER.String():   INTEGER,
+		FLOAT.String():     FLOAT,
+		BOOLEAN.String():   BOOLEAN,
+		TIMESTAMP.String(): TIMESTAMP,
+	}
+
+	modes = map[string]Mode{
+		NULLABLE.String(): NULLABLE,
+		REQUIRED.String(): REQUIRED,
+		REPEATED.String(): REPEATED,
+	}
+)
+
+//Declarative table definition (e.g. kept in source control)
+//JSON and YAML specs have the same fields
+type TableSpec struct {
+	Name         string                `json:"name" yaml:"name"`
+	Columns      []ColumnSpec          `json:"columns" yaml:"columns"`
+	Partitioning *TimePartitioningSpec `json:"partitioning,omitempty" yaml:"partitioning,omitempty"`
+	Clustering   []string              `json:"clustering,omitempty" yaml:"clustering,omitempty"`
+	Labels       map[string]string     `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+type ColumnSpec struct {
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"`
+	//NULLABLE if empty
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+type TimePartitioningSpec struct {
+	Field string `json:"field" yaml:"field"`
+	Type  string `json:"type,omitempty" yaml:"type,omitempty"`
+}
+
+//Parse JSON table spec and return validated Table
+//Types and modes are case-insensitive
+func LoadTableSpec(r io.Reader) (*Table, error) {
+	spec := &TableSpec{}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(spec); err != nil {
+		return nil, fmt.Errorf("Error parsing table spec: %v", err)
+	}
+
+	return spec.Table()
+}
+
+//Parse YAML table spec and return validated Table (see LoadTableSpec)
+func LoadTableSpecYAML(r io.Reader) (*Table, error) {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading table spec: %v", err)
+	}
+
+	spec := &TableSpec{}
+	if err := yaml.UnmarshalStrict(payload, spec); err != nil {
+		return nil, fmt.Errorf("Error parsing table spec: %v", err)
+	}
+
+	return spec.Table()
+}
+
+//Return validated Table from the spec
+func (ts *TableSpec) Table() (*Table, error) {
+	if ts.Name == "" {
+		return nil, errors.New("Table spec name is required")
+	}
+	if len(ts.Columns) == 0 {
+		return nil, fmt.Errorf("Table spec %s: at least one column is required", ts.Name)
+	}
+
+	table := &Table{Name: ts.Name, Columns: Columns{}, Labels: ts.Labels}
+	for _, columnSpec := range ts.Columns {
+		if columnSpec.Name == "" {
+			return nil, fmt.Errorf("Table spec %s: column name is required", ts.Name)
+		}
+		if _, ok := table.Columns[columnSpec.Name]; ok {
+			return nil, fmt.Errorf("Table spec %s: column %s is duplicated", ts.Name, columnSpec.Name)
+		}
+
+		dataType, ok := dataTypes[strings.ToUpper(columnSpec.Type)]
+		if !ok {
+			return nil, fmt.Errorf("Table spec %s: unknown column %s type: %q", ts.Name, columnSpec.Name, columnSpec.Type)
+		}
+
+		mode := NULLABLE
+		if columnSpec.Mode != "" {
+			mode, ok = modes[strings.ToUpper(columnSpec.Mode)]
+			if !ok {
+				return nil, fmt.Errorf("Table spec %s: unknown column %s mode: %s", ts.Name, columnSpec.Name, columnSpec.Mode)
+			}
+		}
+
+		table.Columns[columnSpec.Name] = Column{Type: dataType, Mode: mode}
+	}
+
+	if ts.Partitioning != nil {
+		if ts.Partitioning.Field != "" {
+			if _, ok := table.Columns[ts.Partitioning.Field]; !ok {
+				return nil, fmt.Errorf("Table spec %s: partitioning field %s isn't in the columns", ts.Name, ts.Partitioning.Field)
+			}
+		}
+		table.Partitioning = &TimePartitioning{Field: ts.Partitioning.Field, Type: strings.ToUpper(ts.Partitioning.Type)}
+	}
+
+	for _, field := range ts.Clustering {
+		if _, ok := table.Columns[field]; !ok {
+			return nil, fmt.Errorf("Table spec %s: clustering field %s isn't in the columns", ts.Name, field)
+		}
+	}
+	table.ClusteringFields = ts.Clustering
+
+	return table, nil
+}
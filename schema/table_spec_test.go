@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"github.com/ksensehq/eventnative/test"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadTableSpecFile(t *testing.T) {
+	expected := &Table{
+		Name: "events",
+		Columns: Columns{
+			"_timestamp": Column{Type: TIMESTAMP, Mode: REQUIRED},
+			"user_id":    Column{Type: STRING, Mode: REQUIRED},
+			"event_type": Column{Type: STRING, Mode: NULLABLE},
+			"revenue":    Column{Type: FLOAT, Mode: NULLABLE},
+			"tags":       Column{Type: STRING, Mode: REPEATED},
+		},
+		Partitioning:     &TimePartitioning{Field: "_timestamp", Type: DayPartitionType},
+		ClusteringFields: []string{"user_id", "event_type"},
+		Labels:           map[string]string{"team": "analytics"},
+	}
+
+	tests := []struct {
+		file string
+		load func(io.Reader) (*Table, error)
+	}{
+		{"../test_data/table_spec.json", LoadTableSpec},
+		{"../test_data/table_spec.yaml", LoadTableSpecYAML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(tt.file)
+			require.NoError(t, err)
+			defer f.Close()
+
+			table, err := tt.load(f)
+			require.NoError(t, err)
+			test.ObjectsEqual(t, expected, table, "Tables aren't equal")
+		})
+	}
+}
+
+func TestLoadTableSpecYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		spec          string
+		expectedError string
+	}{
+		{"invalid yaml", "name: [events", "Error parsing table spec"},
+		{"unknown field", "name: events\ncolumns:\n  - name: a\n    type: STRING\nowner: me", "Error parsing table spec"},
+		{"unknown type", "name: events\ncolumns:\n  - name: a\n    type: GEOGRAPHY", "unknown column a type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadTableSpecYAML(strings.NewReader(tt.spec))
+			require.Error(t, err)
+			require.True(t, strings.Contains(err.Error(), tt.expectedError), err.Error())
+		})
+	}
+}
+
+func TestLoadTableSpecErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		spec          string
+		expectedError string
+	}{
+		{"invalid json", `{"name":`, "Error parsing table spec"},
+		{"unknown field", `{"name":"events","columns":[{"name":"a","type":"STRING"}],"owner":"me"}`, "Error parsing table spec"},
+		{"missing name", `{"columns":[{"name":"a","type":"STRING"}]}`, "Table spec name is required"},
+		{"missing columns", `{"name":"events"}`, "at least one column is required"},
+		{"missing column name", `{"name":"events","columns":[{"type":"STRING"}]}`, "column name is required"},
+		{"unknown type", `{"name":"events","columns":[{"name":"a","type":"GEOGRAPHY"}]}`, "unknown column a type"},
+		{"missing type", `{"name":"events","columns":[{"name":"a"}]}`, "unknown column a type"},
+		{"unknown mode", `{"name":"events","columns":[{"name":"a","type":"STRING","mode":"OPTIONAL"}]}`, "unknown column a mode"},
+		{"duplicated column", `{"name":"events","columns":[{"name":"a","type":"STRING"},{"name":"a","type":"FLOAT"}]}`, "column a is duplicated"},
+		{"unknown partitioning field", `{"name":"events","columns":[{"name":"a","type":"STRING"}],"partitioning":{"field":"b"}}`, "partitioning field b"},
+		{"unknown clustering field", `{"name":"events","columns":[{"name":"a","type":"STRING"}],"clustering":["b"]}`, "clustering field b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadTableSpec(strings.NewReader(tt.spec))
+			require.Error(t, err)
+			require.True(t, strings.Contains(err.Error(), tt.expectedError), err.Error())
+		})
+	}
+}
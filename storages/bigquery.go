@@ -24,16 +24,20 @@ type BigQuery struct {
 	breakOnError    bool
 }
 
-func NewBigQuery(ctx context.Context, config *adapters.GoogleConfig, processor *schema.Processor, breakOnError bool) (*BigQuery, error) {
+func NewBigQuery(ctx context.Context, config *adapters.GoogleConfig, processor *schema.Processor, breakOnError bool, clock adapters.Clock) (*BigQuery, error) {
 	gcsAdapter, err := adapters.NewGoogleCloudStorage(ctx, config)
 	if err != nil {
 		return nil, err
 	}
+	gcsAdapter.SetClock(clock)
 
 	bigQueryAdapter, err := adapters.NewBigQuery(ctx, config)
 	if err != nil {
 		return nil, err
 	}
+	bigQueryAdapter.SetClock(clock)
+	//streaming inserts are transformed the same way as staging files
+	bigQueryAdapter.SetColumnTransform(processor.ColumnTransform())
 
 	//create dataset if doesn't exist
 	err = bigQueryAdapter.CreateDataset(config.Dataset)
@@ -115,7 +119,8 @@ func (bq *BigQuery) Store(fileName string, payload []byte) error {
 			if err != nil {
 				return fmt.Errorf("Error getting table %s schema from BigQuery: %v", fdata.DataSchema.Name, err)
 			}
-			if !dbTableSchema.Exists() {
+			//table may exist without columns: they will be added with patch
+			if dbTableSchema == nil {
 				if err := bq.bqAdapter.CreateTable(fdata.DataSchema); err != nil {
 					return fmt.Errorf("Error creating table %s in BigQuery: %v", fdata.DataSchema.Name, err)
 				}
@@ -138,14 +143,13 @@ func (bq *BigQuery) Store(fileName string, payload []byte) error {
 		}
 	}
 
+	var files []*adapters.StagingFile
 	for _, fdata := range flatData {
-		err := bq.gcsAdapter.UploadBytes(fdata.FileName+tableFileKeyDelimiter+fdata.DataSchema.Name, fdata.Payload.Bytes())
-		if err != nil {
-			return err
-		}
+		files = append(files, &adapters.StagingFile{Key: fdata.FileName + tableFileKeyDelimiter + fdata.DataSchema.Name, Payload: fdata.Payload.Bytes()})
 	}
 
-	return nil
+	_, err = bq.gcsAdapter.UploadFiles(files)
+	return err
 }
 
 func (bq BigQuery) Name() string {
@@ -9,9 +9,16 @@ import (
 	"github.com/ksensehq/eventnative/schema"
 	"github.com/spf13/viper"
 	"log"
+	"time"
 )
 
-const defaultTableName = "events"
+const (
+	defaultTableName     = "events"
+	defaultUploadRetries = 3
+	defaultBQRetries     = 5
+
+	defaultMetadataCacheTTL = 30 * time.Second
+)
 
 type DestinationConfig struct {
 	OnlyTokens   []string    `mapstructure:"only_tokens"`
@@ -27,13 +34,17 @@ type DestinationConfig struct {
 type DataLayout struct {
 	Mapping           []string `mapstructure:"mapping"`
 	TableNameTemplate string   `mapstructure:"table_name_template"`
+	FlattenCollision  string   `mapstructure:"flatten_collision"`
+	//column name -> built-in transformation function name (lowercase, uppercase, trim, sha256)
+	ColumnTransforms map[string]string `mapstructure:"column_transforms"`
 }
 
 var unknownDestination = errors.New("Unknown destination type")
 
 //Create event storage from incoming config
 //Enrich incoming configs with default values if needed
-func CreateStorages(ctx context.Context, destinations *viper.Viper) map[string][]events.Storage {
+//clock is used by all storages adapters (e.g. retries backoff, cache TTL)
+func CreateStorages(ctx context.Context, destinations *viper.Viper, clock adapters.Clock) map[string][]events.Storage {
 	stores := map[string][]events.Storage{}
 	if destinations == nil {
 		return stores
@@ -52,16 +63,27 @@ func CreateStorages(ctx context.Context, destinations *viper.Viper) map[string][
 		log.Println("Initializing", name, "destination of type:", destination.Type)
 
 		var mapping []string
+		var columnTransforms map[string]string
+		processorOptions := schema.ProcessorOptions{}
 		tableName := defaultTableName
 		if destination.DataLayout != nil {
 			mapping = destination.DataLayout.Mapping
+			columnTransforms = destination.DataLayout.ColumnTransforms
+			processorOptions.CollisionStrategy = destination.DataLayout.FlattenCollision
 
 			if destination.DataLayout.TableNameTemplate != "" {
 				tableName = destination.DataLayout.TableNameTemplate
 			}
 		}
 
-		processor, err := schema.NewProcessor(tableName, mapping)
+		columnTransform, err := schema.NewColumnTransform(columnTransforms)
+		if err != nil {
+			logError(name, destination.Type, err)
+			continue
+		}
+		processorOptions.ColumnTransform = columnTransform
+
+		processor, err := schema.NewProcessor(tableName, mapping, processorOptions)
 		if err != nil {
 			logError(name, destination.Type, err)
 			continue
@@ -70,9 +92,9 @@ func CreateStorages(ctx context.Context, destinations *viper.Viper) map[string][
 		var storage events.Storage
 		switch destination.Type {
 		case "redshift":
-			storage, err = createRedshift(ctx, name, destination, processor)
+			storage, err = createRedshift(ctx, name, destination, processor, clock)
 		case "bigquery":
-			storage, err = createBigQuery(ctx, name, destination, processor)
+			storage, err = createBigQuery(ctx, name, destination, processor, clock)
 		default:
 			err = unknownDestination
 		}
@@ -103,12 +125,17 @@ func logError(destinationName, destinationType string, err error) {
 }
 
 //Create aws Redshift event storage
-func createRedshift(ctx context.Context, name string, destination DestinationConfig, processor *schema.Processor) (*AwsRedshift, error) {
+func createRedshift(ctx context.Context, name string, destination DestinationConfig, processor *schema.Processor, clock adapters.Clock) (*AwsRedshift, error) {
 	s3Config := destination.S3
 	if err := s3Config.Validate(); err != nil {
 		return nil, err
 	}
 
+	if s3Config.UploadRetries == 0 {
+		s3Config.UploadRetries = defaultUploadRetries
+		log.Printf("name: %s type: redshift s3 upload_retries wasn't provided. Will be used default one: %d", name, s3Config.UploadRetries)
+	}
+
 	redshiftConfig := destination.DataSource
 	if err := redshiftConfig.Validate(); err != nil {
 		return nil, err
@@ -123,11 +150,11 @@ func createRedshift(ctx context.Context, name string, destination DestinationCon
 		log.Printf("name: %s type: redshift schema wasn't provided. Will be used default one: %s", name, redshiftConfig.Schema)
 	}
 
-	return NewAwsRedshift(ctx, s3Config, redshiftConfig, processor, destination.BreakOnError)
+	return NewAwsRedshift(ctx, s3Config, redshiftConfig, processor, destination.BreakOnError, clock)
 }
 
 //Create google BigQuery event storage
-func createBigQuery(ctx context.Context, name string, destination DestinationConfig, processor *schema.Processor) (*BigQuery, error) {
+func createBigQuery(ctx context.Context, name string, destination DestinationConfig, processor *schema.Processor, clock adapters.Clock) (*BigQuery, error) {
 	gConfig := destination.Google
 	if err := gConfig.Validate(); err != nil {
 		return nil, err
@@ -139,5 +166,22 @@ func createBigQuery(ctx context.Context, name string, destination DestinationCon
 		log.Printf("name: %s type: bigquery dataset wasn't provided. Will be used default one: %s", name, gConfig.Dataset)
 	}
 
-	return NewBigQuery(ctx, gConfig, processor, destination.BreakOnError)
+	if gConfig.UploadRetries == 0 {
+		gConfig.UploadRetries = defaultUploadRetries
+		log.Printf("name: %s type: bigquery gcs_upload_retries wasn't provided. Will be used default one: %d", name, gConfig.UploadRetries)
+	}
+	if gConfig.Retries == 0 {
+		gConfig.Retries = defaultBQRetries
+		log.Printf("name: %s type: bigquery bq_retries wasn't provided. Will be used default one: %d", name, gConfig.Retries)
+	}
+	if gConfig.MetadataCacheTTL == 0 {
+		gConfig.MetadataCacheTTL = defaultMetadataCacheTTL
+		log.Printf("name: %s type: bigquery bq_metadata_cache_ttl wasn't provided. Will be used default one: %s", name, gConfig.MetadataCacheTTL)
+	}
+	if gConfig.CircuitBreakerThreshold > 0 && gConfig.CircuitBreakerCooldown <= 0 {
+		gConfig.CircuitBreakerCooldown = time.Minute
+		log.Printf("name: %s type: bigquery circuit breaker cooldown wasn't provided. Will be used default one: %s", name, gConfig.CircuitBreakerCooldown)
+	}
+
+	return NewBigQuery(ctx, gConfig, processor, destination.BreakOnError, clock)
 }
@@ -26,11 +26,12 @@ type AwsRedshift struct {
 }
 
 func NewAwsRedshift(ctx context.Context, s3Config *adapters.S3Config, redshiftConfig *adapters.DataSourceConfig,
-	processor *schema.Processor, breakOnError bool) (*AwsRedshift, error) {
-	s3Adapter, err := adapters.NewAwsS3(s3Config)
+	processor *schema.Processor, breakOnError bool, clock adapters.Clock) (*AwsRedshift, error) {
+	s3Adapter, err := adapters.NewAwsS3(ctx, s3Config)
 	if err != nil {
 		return nil, err
 	}
+	s3Adapter.SetClock(clock)
 
 	redshiftAdapter, err := adapters.NewAwsRedshift(ctx, redshiftConfig, s3Config)
 	if err != nil {